@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slaskis/cloud-echo/echo"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// azureMaxSegment is the longest audio the Azure short audio API accepts in
+// a request.
+const azureMaxSegment = 55 * time.Second
+
+// AzureRecognizer recognizes speech using the Azure Speech to text REST API
+// for short audio.
+//
+// The API recognizes a request's audio at once rather than as a stream, so
+// the audio is split into segments that end with a pause in the speech, or
+// after azureMaxSegment, and each segment is recognized in turn. Only raw
+// 16-bit little endian samples (LINEAR16) are supported.
+type AzureRecognizer struct {
+	ctx        context.Context
+	url        string
+	key        string
+	language   string
+	sampleRate int
+	threshold  float64
+	hangover   int
+	maxBytes   int
+
+	segment  []byte
+	speech   bool
+	quiet    int
+	segments chan []byte
+
+	results chan echo.Result
+	err     error
+}
+
+// NewAzureRecognizer creates a Recognizer of speech in language, sampled at
+// sampleRate hertz, using the speech resource with key in region. A pause
+// is audio quieter than threshold, the RMS level as a fraction of full
+// scale, for as long as vadHangover.
+func NewAzureRecognizer(ctx context.Context, region, key, language string, sampleRate int, threshold float64) *AzureRecognizer {
+	q := url.Values{"language": {language}, "format": {"detailed"}}
+	r := &AzureRecognizer{
+		ctx:        ctx,
+		url:        "https://" + region + ".stt.speech.microsoft.com/speech/recognition/conversation/cognitiveservices/v1?" + q.Encode(),
+		key:        key,
+		language:   language,
+		sampleRate: sampleRate,
+		threshold:  threshold,
+		hangover:   int(vadHangover.Seconds() * float64(sampleRate) * 2),
+		maxBytes:   int(azureMaxSegment.Seconds() * float64(sampleRate) * 2),
+		segments:   make(chan []byte, 16),
+		results:    make(chan echo.Result),
+	}
+	go r.recognize()
+	return r
+}
+
+// SendAudio implements echo.Recognizer.
+func (r *AzureRecognizer) SendAudio(audio []byte) error {
+	if r.ctx.Err() != nil {
+		return r.ctx.Err()
+	}
+	r.segment = append(r.segment, audio...)
+	if rms(audio) >= r.threshold {
+		r.speech = true
+		r.quiet = 0
+	} else {
+		r.quiet += len(audio)
+	}
+	switch {
+	case r.speech && r.quiet >= r.hangover, len(r.segment) >= r.maxBytes:
+		r.flush()
+	case !r.speech && r.quiet >= r.hangover:
+		// don't send the silence before the speech.
+		r.segment = append(r.segment[:0], r.segment[len(r.segment)-r.hangover:]...)
+		r.quiet = len(r.segment)
+	}
+	return nil
+}
+
+// flush queues the current segment to be recognized, if it has speech. The
+// segment is dropped once ctx is done, as nothing recognizes it anymore.
+func (r *AzureRecognizer) flush() {
+	if r.speech {
+		select {
+		case r.segments <- r.segment:
+		case <-r.ctx.Done():
+		}
+	}
+	r.segment = nil
+	r.speech = false
+	r.quiet = 0
+}
+
+// CloseSend implements echo.Recognizer.
+func (r *AzureRecognizer) CloseSend() error {
+	r.flush()
+	close(r.segments)
+	return nil
+}
+
+// Results implements echo.Recognizer.
+func (r *AzureRecognizer) Results() <-chan echo.Result {
+	return r.results
+}
+
+// Err implements echo.Recognizer.
+func (r *AzureRecognizer) Err() error {
+	return r.err
+}
+
+func (r *AzureRecognizer) recognize() {
+	defer close(r.results)
+	for segment := range r.segments {
+		res, err := r.post(segment)
+		if err != nil {
+			stats.addError("recognize")
+			r.err = err
+			// let SendAudio carry on without blocking on a full queue.
+			go func() {
+				for range r.segments {
+				}
+			}()
+			return
+		}
+		if res == nil {
+			continue
+		}
+		stats.addTranscript()
+		select {
+		case r.results <- *res:
+		case <-r.ctx.Done():
+			r.err = r.ctx.Err()
+			return
+		}
+	}
+}
+
+// post recognizes the audio of a segment. It returns nil if there was no
+// speech in it.
+func (r *AzureRecognizer) post(audio []byte) (*echo.Result, error) {
+	ctx, span := traces.Start(r.ctx, "azure.recognize")
+	defer span.End()
+	span.SetAttribute("audio.bytes", len(audio))
+	body := io.MultiReader(bytes.NewReader(wavHeader(r.sampleRate, 1, len(audio))), bytes.NewReader(audio))
+	req, err := http.NewRequest("POST", r.url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Ocp-Apim-Subscription-Key", r.key)
+	req.Header.Set("Content-Type", fmt.Sprintf("audio/wav; codecs=audio/pcm; samplerate=%d", r.sampleRate))
+	req.Header.Set("Accept", "application/json")
+	resp, err := ctxhttp.Do(ctx, nil, req)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot recognize speech: %v", err)
+	}
+	defer resp.Body.Close()
+	if err := azureStatus(resp); err != nil {
+		return nil, fmt.Errorf("Cannot recognize speech: %w", err)
+	}
+
+	var result struct {
+		RecognitionStatus string
+		NBest             []struct {
+			Confidence float32
+			Display    string
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	debugf("Result: %+v", result)
+	if result.RecognitionStatus != "Success" || len(result.NBest) == 0 {
+		return nil, nil
+	}
+	return &echo.Result{
+		Transcript: result.NBest[0].Display,
+		Confidence: result.NBest[0].Confidence,
+		IsFinal:    true,
+		Timestamp:  clock.Now(),
+		Language:   r.language,
+	}, nil
+}
+
+// azureOutputFormats are the names Azure gives the output formats at each
+// sample rate it supports.
+var azureOutputFormats = map[string]map[int]string{
+	"mp3": {
+		16000: "audio-16khz-32kbitrate-mono-mp3",
+		24000: "audio-24khz-48kbitrate-mono-mp3",
+		48000: "audio-48khz-96kbitrate-mono-mp3",
+	},
+	"pcm": {
+		8000:  "raw-8khz-16bit-mono-pcm",
+		16000: "raw-16khz-16bit-mono-pcm",
+		24000: "raw-24khz-16bit-mono-pcm",
+		48000: "raw-48khz-16bit-mono-pcm",
+	},
+	"wav": {
+		8000:  "riff-8khz-16bit-mono-pcm",
+		16000: "riff-16khz-16bit-mono-pcm",
+		24000: "riff-24khz-16bit-mono-pcm",
+		48000: "riff-48khz-16bit-mono-pcm",
+	},
+}
+
+// azureOutputFormat returns the name of format at sampleRate hertz, or an
+// error listing the sample rates Azure supports for it.
+func azureOutputFormat(format string, sampleRate int) (string, error) {
+	rates, ok := azureOutputFormats[format]
+	if !ok {
+		return "", fmt.Errorf("Invalid output format %s for azure, it must be mp3, pcm or wav", format)
+	}
+	name, ok := rates[sampleRate]
+	if !ok {
+		valid := make([]int, 0, len(rates))
+		for r := range rates {
+			valid = append(valid, r)
+		}
+		sort.Ints(valid)
+		names := make([]string, len(valid))
+		for i, r := range valid {
+			names[i] = strconv.Itoa(r)
+		}
+		return "", fmt.Errorf("Invalid sample rate %d for %s with azure, it must be one of %s", sampleRate, format, strings.Join(names, ", "))
+	}
+	return name, nil
+}
+
+// AzureSynthesizer synthesizes speech using Azure Text to speech.
+type AzureSynthesizer struct {
+	url      string
+	key      string
+	language string
+	defaults SynthOptions
+}
+
+// NewAzureSynthesizer creates a Synthesizer speaking language with the
+// defaults, using the speech resource with key in region. The voice is an
+// Azure voice name, without one the first voice for the language is used.
+// The defaults may be overridden per synthesis with withSynthOptions.
+func NewAzureSynthesizer(ctx context.Context, region, key, language string, defaults SynthOptions) (*AzureSynthesizer, error) {
+	if _, err := azureOutputFormat(defaults.Format, defaults.SampleRate); err != nil {
+		return nil, err
+	}
+	base := "https://" + region + ".tts.speech.microsoft.com/cognitiveservices"
+	if defaults.Voice == "" {
+		voice, err := azureVoice(ctx, base+"/voices/list", key, language)
+		if err != nil {
+			return nil, err
+		}
+		defaults.Voice = voice
+	}
+	infof("using azure voice %s", defaults.Voice)
+	return &AzureSynthesizer{
+		url:      base + "/v1",
+		key:      key,
+		language: language,
+		defaults: defaults,
+	}, nil
+}
+
+// azureVoice returns the first voice for language.
+func azureVoice(ctx context.Context, url, key, language string) (string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Ocp-Apim-Subscription-Key", key)
+	resp, err := ctxhttp.Do(ctx, nil, req)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get voices: %v", err)
+	}
+	defer resp.Body.Close()
+	if err := azureStatus(resp); err != nil {
+		return "", fmt.Errorf("Failed to get voices: %w", err)
+	}
+	var voices []struct {
+		ShortName string
+		Locale    string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&voices); err != nil {
+		return "", err
+	}
+	for _, v := range voices {
+		if strings.EqualFold(v.Locale, language) {
+			return v.ShortName, nil
+		}
+	}
+	return "", fmt.Errorf("No azure voices for %s", language)
+}
+
+// Synthesize implements echo.Synthesizer.
+func (a *AzureSynthesizer) Synthesize(ctx context.Context, text string) (io.ReadCloser, error) {
+	o := synthOptions(ctx).merge(a.defaults)
+	format, err := azureOutputFormat(o.Format, o.SampleRate)
+	if err != nil {
+		return nil, err
+	}
+	ctx, span := traces.Start(ctx, "azure.synthesize")
+	defer span.End()
+	span.SetAttribute("voice", o.Voice)
+	span.SetAttribute("text.length", len(text))
+	infof("saying '%s'", text)
+
+	// azure needs the voice in the document, so the text goes inside it.
+	body := escapeSSML(text)
+	switch {
+	case o.TextType != "text" && isSSML(text):
+		body = strings.TrimSpace(text)
+		body = body[strings.Index(body, ">")+1:]
+		body = strings.TrimSuffix(body, "</speak>")
+	case o.TextType == "ssml":
+		body = text
+	}
+	doc := fmt.Sprintf(`<speak version="1.0" xmlns="http://www.w3.org/2001/10/synthesis" xml:lang="%s"><voice name="%s">%s</voice></speak>`, a.language, o.Voice, body)
+
+	req, err := http.NewRequest("POST", a.url, strings.NewReader(doc))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Ocp-Apim-Subscription-Key", a.key)
+	req.Header.Set("Content-Type", "application/ssml+xml")
+	req.Header.Set("X-Microsoft-OutputFormat", format)
+	req.Header.Set("User-Agent", "cloud-echo")
+	resp, err := ctxhttp.Do(ctx, nil, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := azureStatus(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// azureStatus returns an error for a response that isn't OK, an authError
+// if the key was rejected.
+func azureStatus(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return authError{fmt.Errorf("azure rejected the key, check --azure-key and --azure-region: %s", resp.Status)}
+	default:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
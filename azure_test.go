@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/slaskis/cloud-echo/echo"
+)
+
+func TestAzureOutputFormat(t *testing.T) {
+	cases := []struct {
+		format string
+		rate   int
+		want   string
+		err    string
+	}{
+		{"mp3", 16000, "audio-16khz-32kbitrate-mono-mp3", ""},
+		{"mp3", 48000, "audio-48khz-96kbitrate-mono-mp3", ""},
+		{"pcm", 8000, "raw-8khz-16bit-mono-pcm", ""},
+		{"wav", 24000, "riff-24khz-16bit-mono-pcm", ""},
+		{"mp3", 8000, "", "Invalid sample rate 8000 for mp3 with azure, it must be one of 16000, 24000, 48000"},
+		{"pcm", 22050, "", "Invalid sample rate 22050 for pcm with azure, it must be one of 8000, 16000, 24000, 48000"},
+		{"ogg_vorbis", 16000, "", "Invalid output format ogg_vorbis for azure, it must be mp3, pcm or wav"},
+	}
+	for _, c := range cases {
+		got, err := azureOutputFormat(c.format, c.rate)
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("azureOutputFormat(%s, %d) = %s, %v, want %s", c.format, c.rate, got, err, c.err)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("azureOutputFormat(%s, %d) = %s, %v, want %s", c.format, c.rate, got, err, c.want)
+		}
+	}
+}
+
+func TestAzureStatus(t *testing.T) {
+	cases := []struct {
+		status int
+		err    bool
+		auth   bool
+	}{
+		{http.StatusOK, false, false},
+		{http.StatusUnauthorized, true, true},
+		{http.StatusForbidden, true, true},
+		{http.StatusBadRequest, true, false},
+		{http.StatusInternalServerError, true, false},
+	}
+	for _, c := range cases {
+		err := azureStatus(&http.Response{StatusCode: c.status, Status: http.StatusText(c.status)})
+		var auth authError
+		if (err != nil) != c.err || errors.As(err, &auth) != c.auth {
+			t.Errorf("azureStatus(%d) = %v, want error %v, auth error %v", c.status, err, c.err, c.auth)
+		}
+	}
+}
+
+func TestAzureVoice(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Ocp-Apim-Subscription-Key") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, `[{"ShortName":"en-US-JennyNeural","Locale":"en-US"},{"ShortName":"sv-SE-SofieNeural","Locale":"sv-SE"}]`)
+	}))
+	defer srv.Close()
+	cases := []struct {
+		language string
+		key      string
+		want     string
+	}{
+		{"sv-SE", "key", "sv-SE-SofieNeural"},
+		{"en-us", "key", "en-US-JennyNeural"},
+		{"de-DE", "key", ""},
+		{"sv-SE", "wrong", ""},
+	}
+	for _, c := range cases {
+		got, err := azureVoice(context.Background(), srv.URL, c.key, c.language)
+		if (err != nil) != (c.want == "") || got != c.want {
+			t.Errorf("azureVoice(%s) with key %s = %s, %v, want %q", c.language, c.key, got, err, c.want)
+		}
+	}
+}
+
+func TestAzureSynthesize(t *testing.T) {
+	var doc, format string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		doc, format = string(b), r.Header.Get("X-Microsoft-OutputFormat")
+		io.WriteString(w, "speech")
+	}))
+	defer srv.Close()
+	s := &AzureSynthesizer{
+		url:      srv.URL,
+		key:      "key",
+		language: "en-US",
+		defaults: SynthOptions{Voice: "en-US-JennyNeural", Format: "mp3", SampleRate: 16000},
+	}
+	const open = `<speak version="1.0" xmlns="http://www.w3.org/2001/10/synthesis" xml:lang="en-US"><voice name="en-US-JennyNeural">`
+	const end = `</voice></speak>`
+	cases := []struct {
+		name     string
+		textType string
+		text     string
+		want     string
+	}{
+		{"text", "", "hello", "hello"},
+		{"escaped text", "", "rock & roll", "rock &amp; roll"},
+		{"ssml document", "", `<speak><prosody rate="slow">hello</prosody></speak>`, `<prosody rate="slow">hello</prosody>`},
+		{"ssml as text", "text", "<speak>hi</speak>", "&lt;speak&gt;hi&lt;/speak&gt;"},
+		{"ssml fragment", "ssml", `<break time="1s"/>hi`, `<break time="1s"/>hi`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := withSynthOptions(context.Background(), SynthOptions{TextType: c.textType})
+			audio, err := s.Synthesize(ctx, c.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := ioutil.ReadAll(audio)
+			audio.Close()
+			if string(b) != "speech" {
+				t.Errorf("synthesized %q, want %q", b, "speech")
+			}
+			if want := open + c.want + end; doc != want {
+				t.Errorf("sent\n%s\nwant\n%s", doc, want)
+			}
+			if format != "audio-16khz-32kbitrate-mono-mp3" {
+				t.Errorf("asked for %s", format)
+			}
+		})
+	}
+}
+
+func TestAzureRecognizer(t *testing.T) {
+	var sizes []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		// without the wav header.
+		sizes = append(sizes, len(b)-44)
+		fmt.Fprintf(w, `{"RecognitionStatus":"Success","NBest":[{"Confidence":0.9,"Display":"segment %d"}]}`, len(sizes))
+	}))
+	defer srv.Close()
+	// a hangover of 500ms at 1kHz is 1000 bytes, and segments are cut
+	// after 4000.
+	r := &AzureRecognizer{
+		ctx:        context.Background(),
+		url:        srv.URL,
+		language:   "en-US",
+		sampleRate: 1000,
+		threshold:  0.1,
+		hangover:   1000,
+		maxBytes:   4000,
+		segments:   make(chan []byte, 16),
+		results:    make(chan echo.Result),
+	}
+	go r.recognize()
+
+	speech := bytes.Repeat(samples(math.MaxInt16/2, -math.MaxInt16/2), 100)
+	chunks := [][]byte{
+		// only the hangover of the silence before the speech is kept.
+		make([]byte, 1500),
+		speech[:200],
+		// a pause ends the segment.
+		make([]byte, 1000),
+	}
+	// a segment is cut when it's too long, the rest is sent on close.
+	for i := 0; i < 11; i++ {
+		chunks = append(chunks, speech[:400])
+	}
+	for _, chunk := range chunks {
+		if err := r.SendAudio(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for res := range r.Results() {
+		if !res.IsFinal || res.Language != "en-US" || res.Confidence != 0.9 {
+			t.Errorf("unexpected result %+v", res)
+		}
+		got = append(got, res.Transcript)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"segment 1", "segment 2", "segment 3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recognized %q, want %q", got, want)
+	}
+	if want := []int{2200, 4000, 400}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("posted segments of %v bytes, want %v", sizes, want)
+	}
+}
+
+func TestAzureRecognizerCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// nothing recognizes the segments, as after the recognizer has stopped.
+	r := &AzureRecognizer{
+		ctx:      ctx,
+		segment:  []byte("speech"),
+		speech:   true,
+		segments: make(chan []byte),
+	}
+	done := make(chan error)
+	go func() { done <- r.CloseSend() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("CloseSend blocked on the segment after the context was cancelled")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/slaskis/cloud-echo/echo"
+)
+
+// batchFiles lists the audio files of --batch, which is either a directory
+// or a glob.
+func batchFiles(pattern string) ([]string, error) {
+	if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+		pattern = filepath.Join(pattern, "*")
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range matches {
+		if info, err := os.Stat(name); err == nil && !info.IsDir() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no files match %s", pattern)
+	}
+	return names, nil
+}
+
+// runBatch echoes each file of --batch with a recognizer of its own, and
+// writes its speech to a directory named after it in the output directory.
+// A file that fails doesn't stop the rest, they're all reported at the end.
+func runBatch(ctx context.Context, e *echo.Echo, files *fileWriter, stopped <-chan struct{}, newRec func() (echo.Recognizer, error)) error {
+	names, err := batchFiles(opts.batch)
+	if err != nil {
+		return err
+	}
+	errs := make(map[string]error)
+	done := 0
+	for _, name := range names {
+		select {
+		case <-stopped:
+		default:
+			errs[name] = echoFile(ctx, *e, files, stopped, newRec, name)
+			done++
+			continue
+		}
+		break
+	}
+
+	failed := 0
+	for _, name := range names[:done] {
+		if err := errs[name]; err != nil {
+			errorf("FAIL %s: %v", name, err)
+			failed++
+			continue
+		}
+		infof("OK %s", name)
+	}
+	if done < len(names) {
+		warnf("stopped before %d of %d files", len(names)-done, len(names))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, done)
+	}
+	return nil
+}
+
+// echoFile echoes a file of a batch.
+func echoFile(ctx context.Context, e echo.Echo, files *fileWriter, stopped <-chan struct{}, newRec func() (echo.Recognizer, error), name string) error {
+	if err := checkInputHeader(name); err != nil {
+		return err
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("Failed to open input: %v", err)
+	}
+	defer file.Close()
+
+	if files != nil {
+		files.dir = filepath.Join(opts.outDir, strings.TrimSuffix(filepath.Base(name), filepath.Ext(name)))
+		files.start = clock.Now()
+		files.seq = 0
+		if err := os.MkdirAll(files.dir, 0755); err != nil {
+			return fmt.Errorf("Failed to create output directory %s: %v", files.dir, err)
+		}
+	}
+
+	e.Recognizer, err = newRec()
+	if err != nil {
+		return err
+	}
+	infof("echoing %s", name)
+	return e.Run(ctx, stopReader{file, stopped})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/slaskis/cloud-echo/echo"
+)
+
+// channelRecognizer splits interleaved multi-channel audio into one stream
+// per channel, each recognized separately. It only works with raw 16-bit
+// samples (LINEAR16).
+type channelRecognizer struct {
+	recs    []echo.Recognizer
+	partial []byte
+	buf     [][]byte
+
+	results chan echo.Result
+	err     error
+}
+
+// newChannelRecognizer recognizes channel i+1 of the audio with recs[i].
+func newChannelRecognizer(ctx context.Context, recs []echo.Recognizer) *channelRecognizer {
+	r := &channelRecognizer{
+		recs:    recs,
+		buf:     make([][]byte, len(recs)),
+		results: make(chan echo.Result),
+	}
+	var wg sync.WaitGroup
+	var once sync.Once
+	for i, rec := range recs {
+		wg.Add(1)
+		go func(channel int, rec echo.Recognizer) {
+			defer wg.Done()
+			for res := range rec.Results() {
+				res.Channel = channel
+				select {
+				case r.results <- res:
+				case <-ctx.Done():
+					once.Do(func() { r.err = ctx.Err() })
+					return
+				}
+			}
+			if err := rec.Err(); err != nil {
+				once.Do(func() { r.err = err })
+			}
+		}(i+1, rec)
+	}
+	go func() {
+		wg.Wait()
+		close(r.results)
+	}()
+	return r
+}
+
+// SendAudio implements echo.Recognizer.
+func (r *channelRecognizer) SendAudio(audio []byte) error {
+	frame := 2 * len(r.recs)
+	// a chunk can end in the middle of a frame, keep the rest for the next.
+	audio = append(r.partial, audio...)
+	n := len(audio) - len(audio)%frame
+	r.partial = append([]byte(nil), audio[n:]...)
+
+	for i := range r.buf {
+		r.buf[i] = r.buf[i][:0]
+	}
+	for off := 0; off < n; off += frame {
+		for i := range r.recs {
+			r.buf[i] = append(r.buf[i], audio[off+2*i], audio[off+2*i+1])
+		}
+	}
+	for i, rec := range r.recs {
+		if len(r.buf[i]) == 0 {
+			continue
+		}
+		if err := rec.SendAudio(r.buf[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CloseSend implements echo.Recognizer.
+func (r *channelRecognizer) CloseSend() error {
+	var err error
+	for _, rec := range r.recs {
+		if e := rec.CloseSend(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Results implements echo.Recognizer.
+func (r *channelRecognizer) Results() <-chan echo.Result {
+	return r.results
+}
+
+// Err implements echo.Recognizer.
+func (r *channelRecognizer) Err() error {
+	return r.err
+}
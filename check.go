@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	speech "cloud.google.com/go/speech/apiv1"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/polly"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+)
+
+// checkTimeout is how long each step of a check may take.
+const checkTimeout = 15 * time.Second
+
+// checkStep is a step of a check.
+type checkStep struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// runCheck checks that the services the echo needs can be reached, without
+// capturing any audio, and writes PASS or FAIL for each step to w. It
+// returns the first failure, if any step failed.
+func runCheck(ctx context.Context, w io.Writer, encoding speechpb.RecognitionConfig_AudioEncoding, language string) error {
+	var steps []checkStep
+	if opts.sttBackend == "google" || opts.translateTo != "" {
+		steps = append(steps, checkStep{"google credentials", checkGoogleCredentials})
+	}
+	if opts.sttBackend == "google" {
+		steps = append(steps, checkStep{"google speech recognition", func(ctx context.Context) error {
+			client, err := speech.NewClient(ctx)
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+			rec, err := NewGoogleRecognizer(ctx, client, streamingConfig(opts.language, encoding, nil), 0, 0)
+			if err != nil {
+				return err
+			}
+			if err := rec.CloseSend(); err != nil {
+				return err
+			}
+			for range rec.Results() {
+			}
+			return rec.Err()
+		}})
+	}
+	if opts.ttsBackend == "polly" {
+		steps = append(steps, checkStep{"polly voices", func(ctx context.Context) error {
+			sess, err := newSession()
+			if err != nil {
+				return err
+			}
+			resp, err := polly.New(sess).DescribeVoicesWithContext(ctx, &polly.DescribeVoicesInput{
+				LanguageCode: aws.String(language),
+			})
+			if err != nil {
+				return err
+			}
+			if len(resp.Voices) == 0 {
+				return fmt.Errorf("no voices for %s", language)
+			}
+			return nil
+		}})
+	}
+	steps = append(steps, checkStep{opts.ttsBackend + " speech synthesis", func(ctx context.Context) error {
+		synth, err := newSynthesizer(language)
+		if err != nil {
+			return err
+		}
+		audio, err := synth.Synthesize(ctx, "test")
+		if err != nil {
+			return err
+		}
+		defer audio.Close()
+		n, err := io.Copy(ioutil.Discard, audio)
+		if err == nil && n == 0 {
+			err = fmt.Errorf("no audio")
+		}
+		return err
+	}})
+
+	var first error
+	failed := 0
+	for _, step := range steps {
+		ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+		err := step.run(ctx)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(w, "FAIL %s: %v\n", step.name, err)
+			if first == nil {
+				first = err
+			}
+			failed++
+			continue
+		}
+		fmt.Fprintf(w, "PASS %s\n", step.name)
+	}
+	if first != nil {
+		return fmt.Errorf("%d of %d checks failed: %w", failed, len(steps), first)
+	}
+	return nil
+}
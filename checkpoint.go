@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/slaskis/cloud-echo/echo"
+)
+
+// checkpointInterval is how often the --checkpoint file is written.
+const checkpointInterval = 5 * time.Second
+
+// checkpoint writes how far into the input file the echo has come to a
+// file, as the offset in bytes of the audio read when the last final
+// transcript whose speech has been written was recognized, so that a run
+// can be resumed from it with --resume-from. All methods are no-ops on a
+// nil *checkpoint.
+type checkpoint struct {
+	path string
+	// read is the offset of the audio read so far, and done that of the
+	// last final transcript that has been written.
+	read int64
+	done int64
+
+	mu sync.Mutex
+	// pending are the final transcripts that haven't been written yet.
+	pending []pendingFinal
+	// ended is set once the end of the input has been read.
+	ended int32
+	stop  chan struct{}
+	exit  chan struct{}
+}
+
+func newCheckpoint(path string, offset int64) *checkpoint {
+	c := &checkpoint{
+		path: path,
+		read: offset,
+		done: offset,
+		stop: make(chan struct{}),
+		exit: make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// reader counts the audio read from r, which has been read up to the
+// offset the checkpoint started at.
+func (c *checkpoint) reader(r io.Reader) io.Reader {
+	if c == nil {
+		return r
+	}
+	return checkpointReader{r, c}
+}
+
+// pendingFinal is the offset of the audio read when a final transcript was
+// recognized.
+type pendingFinal struct {
+	timestamp time.Time
+	offset    int64
+}
+
+// recognized records the audio read so far for the final result res, which
+// the checkpoint moves up to once res has been written.
+func (c *checkpoint) recognized(res echo.Result) {
+	if c == nil || !res.IsFinal {
+		return
+	}
+	c.mu.Lock()
+	c.pending = append(c.pending, pendingFinal{res.Timestamp, atomic.LoadInt64(&c.read)})
+	c.mu.Unlock()
+}
+
+// written moves the checkpoint up to the audio read when res was
+// recognized. The results before it that were skipped are done too. Results
+// are written in the order they're recognized, so if another one has the
+// same timestamp it's the first of them, which is never further along.
+func (c *checkpoint) written(res echo.Result) {
+	if c == nil || !res.IsFinal {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, p := range c.pending {
+		if p.timestamp.Equal(res.Timestamp) {
+			atomic.StoreInt64(&c.done, p.offset)
+			c.pending = c.pending[i+1:]
+			return
+		}
+	}
+}
+
+// Close writes the checkpoint a last time. If the echo succeeded after
+// reading all of the input it's all done, and the checkpoint is at its end.
+func (c *checkpoint) Close(succeeded bool) error {
+	if c == nil {
+		return nil
+	}
+	close(c.stop)
+	<-c.exit
+	if succeeded && atomic.LoadInt32(&c.ended) == 1 {
+		atomic.StoreInt64(&c.done, atomic.LoadInt64(&c.read))
+	}
+	return c.write()
+}
+
+func (c *checkpoint) run() {
+	defer close(c.exit)
+	ticker := clock.NewTicker(checkpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			if err := c.write(); err != nil {
+				warnf("Could not write checkpoint: %v", err)
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// write replaces the checkpoint file, so that it's never half written.
+func (c *checkpoint) write() error {
+	tmp := c.path + ".tmp"
+	offset := strconv.FormatInt(atomic.LoadInt64(&c.done), 10)
+	if err := ioutil.WriteFile(tmp, []byte(offset+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// checkpointReader counts the bytes read for a checkpoint.
+type checkpointReader struct {
+	r io.Reader
+	c *checkpoint
+}
+
+func (r checkpointReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddInt64(&r.c.read, int64(n))
+	if err == io.EOF {
+		atomic.StoreInt32(&r.c.ended, 1)
+	}
+	return n, err
+}
+
+// resumeOffset parses --resume-from, which is either an offset in bytes or
+// a checkpoint file with one.
+func resumeOffset(s string) (int64, error) {
+	if offset, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if offset < 0 {
+			return 0, fmt.Errorf("Invalid --resume-from %d, it can't be negative", offset)
+		}
+		return offset, nil
+	}
+	b, err := ioutil.ReadFile(s)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to read checkpoint: %v", err)
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("Invalid checkpoint %s, it should have an offset in bytes", s)
+	}
+	return offset, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slaskis/cloud-echo/echo"
+)
+
+func TestCheckpoint(t *testing.T) {
+	at := func(s int) echo.Result {
+		return echo.Result{IsFinal: true, Timestamp: time.Unix(int64(s), 0)}
+	}
+	type step struct {
+		read      int
+		recognize *echo.Result
+		write     *echo.Result
+		done      int64
+	}
+	one, two, three := at(1), at(2), at(3)
+	interim := echo.Result{Timestamp: time.Unix(4, 0)}
+	cases := []struct {
+		name  string
+		steps []step
+	}{
+		{"written", []step{
+			{read: 10, recognize: &one, done: 0},
+			{read: 5, done: 0},
+			{write: &one, done: 10},
+		}},
+		{"written after the next is recognized", []step{
+			{read: 10, recognize: &one},
+			{read: 10, recognize: &two, done: 0},
+			{write: &one, done: 10},
+			{write: &two, done: 20},
+		}},
+		{"skipped", []step{
+			{read: 10, recognize: &one},
+			{read: 10, recognize: &two},
+			{read: 10, recognize: &three},
+			{write: &two, done: 20},
+			{write: &three, done: 30},
+		}},
+		{"interim", []step{
+			{read: 10, recognize: &interim},
+			{write: &interim, done: 0},
+		}},
+		{"same timestamp", []step{
+			{read: 10, recognize: &one},
+			{read: 10, recognize: &one},
+			{write: &one, done: 10},
+			{write: &one, done: 20},
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "checkpoint")
+			cp := newCheckpoint(path, 0)
+			r := cp.reader(strings.NewReader(strings.Repeat("x", 100)))
+			for i, s := range c.steps {
+				if _, err := r.Read(make([]byte, s.read)); err != nil && s.read > 0 {
+					t.Fatal(err)
+				}
+				if s.recognize != nil {
+					cp.recognized(*s.recognize)
+				}
+				if s.write != nil {
+					cp.written(*s.write)
+				}
+				if got := cp.done; got != s.done {
+					t.Fatalf("step %d: done = %d, want %d", i, got, s.done)
+				}
+			}
+			if err := cp.Close(true); err != nil {
+				t.Fatal(err)
+			}
+			// the input hasn't all been read, so it's left where it was.
+			if got := resumable(t, path); got != cp.done {
+				t.Errorf("resumes from %d, want %d", got, cp.done)
+			}
+		})
+	}
+}
+
+// resumable returns the offset resumed from the checkpoint at path.
+func resumable(t *testing.T, path string) int64 {
+	offset, err := resumeOffset(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return offset
+}
+
+func TestCheckpointEnded(t *testing.T) {
+	for _, succeeded := range []bool{true, false} {
+		path := filepath.Join(t.TempDir(), "checkpoint")
+		cp := newCheckpoint(path, 100)
+		if _, err := ioutil.ReadAll(cp.reader(strings.NewReader("0123456789"))); err != nil {
+			t.Fatal(err)
+		}
+		if err := cp.Close(succeeded); err != nil {
+			t.Fatal(err)
+		}
+		want := int64(100)
+		if succeeded {
+			want = 110
+		}
+		if got := resumable(t, path); got != want {
+			t.Errorf("succeeded %v: resumes from %d, want %d", succeeded, got, want)
+		}
+	}
+}
+
+func TestResumeOffset(t *testing.T) {
+	dir := t.TempDir()
+	file := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	cases := []struct {
+		arg  string
+		want int64
+		err  bool
+	}{
+		{"0", 0, false},
+		{"1234", 1234, false},
+		{"-1", 0, true},
+		{file("ok", "42\n"), 42, false},
+		{file("negative", "-42\n"), 0, true},
+		{file("garbage", "forty two\n"), 0, true},
+		{filepath.Join(dir, "missing"), 0, true},
+	}
+	for _, c := range cases {
+		got, err := resumeOffset(c.arg)
+		if (err != nil) != c.err {
+			t.Errorf("resumeOffset(%s) error = %v, want error %v", c.arg, err, c.err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("resumeOffset(%s) = %d, want %d", c.arg, got, c.want)
+		}
+	}
+}
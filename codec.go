@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+)
+
+// codec is an audio encoding that both sox can record and the speech API
+// can recognize.
+type codec struct {
+	encoding speechpb.RecognitionConfig_AudioEncoding
+	// soxArgs are the sox arguments for writing the encoding.
+	soxArgs []string
+	// sampleRate is the default sample rate.
+	sampleRate int
+	// outFormat is the default polly output format.
+	outFormat string
+	// sampleSize is the bytes per sample, 0 for compressed encodings.
+	sampleSize int
+}
+
+var codecs = map[string]codec{
+	"flac":     {speechpb.RecognitionConfig_FLAC, []string{"-t", "flac"}, 16000, "mp3", 0},
+	"linear16": {speechpb.RecognitionConfig_LINEAR16, []string{"-t", "raw", "-e", "signed", "-b", "16", "-L"}, 16000, "mp3", 2},
+	// mu-law is telephony audio, which is echoed as raw 8kHz samples as
+	// polly can't encode mu-law.
+	"mulaw": {speechpb.RecognitionConfig_MULAW, []string{"-t", "raw", "-e", "mu-law", "-b", "8"}, 8000, "pcm", 1},
+}
+
+// lookupCodec returns the codec with the given name.
+func lookupCodec(name string) (codec, error) {
+	c, ok := codecs[strings.ToLower(name)]
+	if !ok {
+		names := make([]string, 0, len(codecs))
+		for name := range codecs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return codec{}, fmt.Errorf("Invalid codec %s, supported codecs: %s", name, strings.Join(names, ", "))
+	}
+	return c, nil
+}
+
+// wrapWAV reads all of the 16-bit mono samples at sampleRate hertz of
+// audio, and returns them with a wav header, which needs their size.
+func wrapWAV(audio io.ReadCloser, sampleRate int) (io.ReadCloser, error) {
+	defer audio.Close()
+	samples, err := ioutil.ReadAll(audio)
+	if err != nil {
+		return nil, err
+	}
+	header := wavHeader(sampleRate, 1, len(samples))
+	return ioutil.NopCloser(io.MultiReader(bytes.NewReader(header), bytes.NewReader(samples))), nil
+}
+
+// wavHeader returns the header of a wav file of size bytes of 16-bit
+// samples at sampleRate hertz.
+func wavHeader(sampleRate, channels, size int) []byte {
+	h := make([]byte, 44)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], uint32(36+size))
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1) // pcm
+	binary.LittleEndian.PutUint16(h[22:], uint16(channels))
+	binary.LittleEndian.PutUint32(h[24:], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(sampleRate*channels*2))
+	binary.LittleEndian.PutUint16(h[32:], uint16(channels*2))
+	binary.LittleEndian.PutUint16(h[34:], 16)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], uint32(size))
+	return h
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+)
+
+func TestLookupCodec(t *testing.T) {
+	cases := []struct {
+		name       string
+		encoding   speechpb.RecognitionConfig_AudioEncoding
+		sampleRate int
+		outFormat  string
+		sampleSize int
+	}{
+		{"flac", speechpb.RecognitionConfig_FLAC, 16000, "mp3", 0},
+		{"linear16", speechpb.RecognitionConfig_LINEAR16, 16000, "mp3", 2},
+		{"LINEAR16", speechpb.RecognitionConfig_LINEAR16, 16000, "mp3", 2},
+		{"mulaw", speechpb.RecognitionConfig_MULAW, 8000, "pcm", 1},
+	}
+	for _, c := range cases {
+		got, err := lookupCodec(c.name)
+		if err != nil {
+			t.Errorf("lookupCodec(%s): %v", c.name, err)
+			continue
+		}
+		if got.encoding != c.encoding || got.sampleRate != c.sampleRate || got.outFormat != c.outFormat || got.sampleSize != c.sampleSize {
+			t.Errorf("lookupCodec(%s) = %s at %d hertz, %d bytes a sample, echoed as %s, want %s at %d, %d, %s",
+				c.name, got.encoding, got.sampleRate, got.sampleSize, got.outFormat, c.encoding, c.sampleRate, c.sampleSize, c.outFormat)
+		}
+	}
+	if _, err := lookupCodec("opus"); err == nil {
+		t.Error("lookupCodec(opus) found a codec")
+	}
+}
+
+func TestWAVHeader(t *testing.T) {
+	want := []byte{
+		'R', 'I', 'F', 'F',
+		0x2c, 0x01, 0x00, 0x00, // 36 + 264 bytes
+		'W', 'A', 'V', 'E',
+		'f', 'm', 't', ' ',
+		0x10, 0x00, 0x00, 0x00, // 16 bytes of format
+		0x01, 0x00, // pcm
+		0x01, 0x00, // one channel
+		0x80, 0x3e, 0x00, 0x00, // 16000 hertz
+		0x00, 0x7d, 0x00, 0x00, // 32000 bytes a second
+		0x02, 0x00, // 2 bytes a frame
+		0x10, 0x00, // 16 bits a sample
+		'd', 'a', 't', 'a',
+		0x08, 0x01, 0x00, 0x00, // 264 bytes of samples
+	}
+	if got := wavHeader(16000, 1, 264); !bytes.Equal(got, want) {
+		t.Errorf("wavHeader(16000, 1, 264) =\n% x\nwant\n% x", got, want)
+	}
+
+	stereo := wavHeader(8000, 2, 0)
+	if got := binary.LittleEndian.Uint16(stereo[22:]); got != 2 {
+		t.Errorf("stereo header has %d channels, want 2", got)
+	}
+	if got := binary.LittleEndian.Uint32(stereo[28:]); got != 32000 {
+		t.Errorf("stereo header has %d bytes a second, want 32000", got)
+	}
+	if got := binary.LittleEndian.Uint16(stereo[32:]); got != 4 {
+		t.Errorf("stereo header has %d bytes a frame, want 4", got)
+	}
+}
+
+func TestWrapWAV(t *testing.T) {
+	samples := []byte{1, 2, 3, 4, 5, 6}
+	wav, err := wrapWAV(ioutil.NopCloser(bytes.NewReader(samples)), 8000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wav.Close()
+	b, err := ioutil.ReadAll(wav)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(wavHeader(8000, 1, len(samples)), samples...)
+	if !bytes.Equal(b, want) {
+		t.Errorf("wrapped as % x, want % x", b, want)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// loadConfig sets the flags of fs that weren't given on the command line
+// from a config file. The file has a flag per line, named as on the command line,
+// as either "name: value" (YAML) or "name = value" (TOML). Blank lines and
+// lines starting with # are ignored, and values may be quoted.
+func loadConfig(fs *flag.FlagSet, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// flags given on the command line take precedence.
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexAny(line, ":=")
+		if i < 0 {
+			return fmt.Errorf("%s:%d: expected name: value or name = value", path, n)
+		}
+		name := strings.Replace(strings.TrimSpace(line[:i]), "_", "-", -1)
+		value := unquote(strings.TrimSpace(line[i+1:]))
+		if fs.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("%s:%d: unknown option %s", path, n, name)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: invalid %s: %v", path, n, name, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// envPrefix is the prefix of the environment variables that set flags,
+// such as CLOUD_ECHO_LANGUAGE for --language.
+const envPrefix = "CLOUD_ECHO_"
+
+// loadEnv sets the flags of fs that weren't given on the command line from
+// the environment variables in env, given as "key=value".
+func loadEnv(fs *flag.FlagSet, env []string) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, envPrefix) {
+			continue
+		}
+		kv = strings.TrimPrefix(kv, envPrefix)
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			continue
+		}
+		name := strings.ToLower(strings.Replace(kv[:i], "_", "-", -1))
+		if fs.Lookup(name) == nil {
+			warnf("Ignoring %s%s, there's no --%s", envPrefix, kv[:i], name)
+			continue
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, kv[i+1:]); err != nil {
+			return fmt.Errorf("invalid %s%s: %v", envPrefix, kv[:i], err)
+		}
+	}
+	return nil
+}
+
+// unquote removes the quotes around a value, or a trailing comment from an
+// unquoted one. A double quoted value may have Go escapes, as printed by
+// printConfig, a single quoted one is taken as it is.
+func unquote(value string) string {
+	if len(value) >= 2 && value[0] == '"' {
+		for i := 1; i < len(value); i++ {
+			switch value[i] {
+			case '\\':
+				i++
+			case '"':
+				if s, err := strconv.Unquote(value[:i+1]); err == nil {
+					return s
+				}
+				return value[1:i]
+			}
+		}
+	}
+	if len(value) >= 2 && value[0] == '\'' {
+		if i := strings.IndexByte(value[1:], value[0]); i >= 0 {
+			return value[1 : i+1]
+		}
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value
+}
+
+// printConfig writes the effective options of fs in the format read by
+// loadConfig.
+func printConfig(w io.Writer, fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		_, err = fmt.Fprintf(w, "%s = %q\n", f.Name, f.Value.String())
+	})
+	return err
+}
+
+// isFlagSet reports whether the flag name was given on the command line or
+// in the config file.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// stringsFlag is a flag that may be repeated, or given comma separated
+// values, to build a list.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*f = append(*f, v)
+		}
+	}
+	return nil
+}
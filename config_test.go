@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		env      []string
+		file     string
+		language string
+		rate     int
+	}{
+		{
+			name:     "defaults",
+			language: "sv-SE",
+			rate:     16000,
+		},
+		{
+			name:     "file",
+			file:     "language: en-US\nsample_rate = 8000\n",
+			language: "en-US",
+			rate:     8000,
+		},
+		{
+			name:     "quoted values and comments",
+			file:     "# a comment\n\nlanguage: \"en-GB\"\nsample-rate: 8000 # telephony\n",
+			language: "en-GB",
+			rate:     8000,
+		},
+		{
+			name:     "flags over file",
+			args:     []string{"--language", "fi-FI"},
+			file:     "language: en-US\nsample-rate: 8000\n",
+			language: "fi-FI",
+			rate:     8000,
+		},
+		{
+			name:     "env",
+			env:      []string{"HOME=/root", "CLOUD_ECHO_LANGUAGE=de-DE", "CLOUD_ECHO_SAMPLE_RATE=8000"},
+			language: "de-DE",
+			rate:     8000,
+		},
+		{
+			name:     "env over file",
+			env:      []string{"CLOUD_ECHO_LANGUAGE=de-DE"},
+			file:     "language: en-US\nsample-rate: 8000\n",
+			language: "de-DE",
+			rate:     8000,
+		},
+		{
+			name:     "flags over env",
+			args:     []string{"--language", "fi-FI"},
+			env:      []string{"CLOUD_ECHO_LANGUAGE=de-DE", "CLOUD_ECHO_SAMPLE_RATE=22050"},
+			language: "fi-FI",
+			rate:     22050,
+		},
+		{
+			name:     "flags over env over file",
+			args:     []string{"--language", "fi-FI"},
+			env:      []string{"CLOUD_ECHO_LANGUAGE=de-DE", "CLOUD_ECHO_SAMPLE_RATE=22050"},
+			file:     "language: en-US\nsample-rate: 8000\n",
+			language: "fi-FI",
+			rate:     22050,
+		},
+		{
+			name:     "unknown and malformed env are ignored",
+			env:      []string{"CLOUD_ECHO_NOPE=1", "CLOUD_ECHO_LANGUAGE"},
+			language: "sv-SE",
+			rate:     16000,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, language, rate := testFlags()
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if err := loadEnv(fs, tt.env); err != nil {
+				t.Fatal(err)
+			}
+			if tt.file != "" {
+				if err := loadConfig(fs, writeConfig(t, tt.file)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if *language != tt.language || *rate != tt.rate {
+				t.Errorf("got --language %s --sample-rate %d, want %s and %d", *language, *rate, tt.language, tt.rate)
+			}
+		})
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+	}{
+		{"no separator", "language en-US\n"},
+		{"unknown option", "voice: Astrid\n"},
+		{"config in config", "config: other.yaml\n"},
+		{"invalid value", "sample-rate: fast\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, _, _ := testFlags()
+			if err := loadConfig(fs, writeConfig(t, tt.file)); err == nil {
+				t.Errorf("loadConfig(%q) succeeded", tt.file)
+			}
+		})
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	newFlags := func() *flag.FlagSet {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.String("config", "", "")
+		fs.Bool("print-config", false, "")
+		fs.String("ssml-template", "", "")
+		fs.String("output-dir", "", "")
+		fs.String("phrases", "", "")
+		fs.Int("sample-rate", 16000, "")
+		return fs
+	}
+	values := map[string]string{
+		"ssml-template": `<speak><prosody rate="fast">{{.}}</prosody></speak>`,
+		"output-dir":    `C:\speech\out # not a comment`,
+		"phrases":       "a=b, c: d, 'e', \"f\"\ngräs",
+		"sample-rate":   "8000",
+	}
+	printed := newFlags()
+	for name, value := range values {
+		if err := printed.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var config bytes.Buffer
+	if err := printConfig(&config, printed); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(config.String(), "config =") {
+		t.Errorf("printed --config or --print-config:\n%s", config.String())
+	}
+
+	loaded := newFlags()
+	if err := loadConfig(loaded, writeConfig(t, config.String())); err != nil {
+		t.Fatalf("loadConfig() = %v, printed:\n%s", err, config.String())
+	}
+	for name, want := range values {
+		if got := loaded.Lookup(name).Value.String(); got != want {
+			t.Errorf("--%s loaded as %q, want %q", name, got, want)
+		}
+	}
+}
+
+func testFlags() (*flag.FlagSet, *string, *int) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("config", "", "")
+	language := fs.String("language", "sv-SE", "")
+	rate := fs.Int("sample-rate", 16000, "")
+	return fs, language, rate
+}
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEnvError(t *testing.T) {
+	fs, _, _ := testFlags()
+	if err := loadEnv(fs, []string{"CLOUD_ECHO_SAMPLE_RATE=fast"}); err == nil {
+		t.Error("loadEnv with an invalid sample rate succeeded")
+	}
+}
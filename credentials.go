@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	speech "cloud.google.com/go/speech/apiv1"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"golang.org/x/oauth2/google"
+)
+
+// checkGoogleCredentials fails early, with a hint on how to fix it, when no
+// Google credentials can be found.
+func checkGoogleCredentials(ctx context.Context) error {
+	if _, err := google.FindDefaultCredentials(ctx, speech.DefaultAuthScopes()...); err != nil {
+		return authError{fmt.Errorf("No Google credentials found, set GOOGLE_APPLICATION_CREDENTIALS to the path of a service account key or run `gcloud auth application-default login`: %v", err)}
+	}
+	return nil
+}
+
+// checkAWSCredentials fails early, with a hint on how to fix it, when sess
+// has no AWS credentials.
+func checkAWSCredentials(sess *session.Session) error {
+	if _, err := sess.Config.Credentials.Get(); err != nil {
+		return authError{fmt.Errorf("No AWS credentials found, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or configure a profile with `aws configure`: %v", err)}
+	}
+	return nil
+}
+
+// authError is an error caused by missing or invalid credentials.
+type authError struct {
+	error
+}
+
+func (e authError) Unwrap() error { return e.error }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	speech "cloud.google.com/go/speech/apiv1"
+	"github.com/googleapis/gax-go"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+)
+
+// detectDuration is how much audio the language is detected from.
+const detectDuration = 3 * time.Second
+
+// recognizeClient recognizes the speech of a request at once, like
+// speech.Client does.
+type recognizeClient interface {
+	Recognize(ctx context.Context, req *speechpb.RecognizeRequest, opts ...gax.CallOption) (*speechpb.RecognizeResponse, error)
+}
+
+// detectLanguage recognizes a sample of the input in each of languages,
+// and returns the one recognized with the highest confidence. It returns
+// "" if none of them recognized anything.
+func detectLanguage(ctx context.Context, c codec, encoding speechpb.RecognitionConfig_AudioEncoding, languages []string) (string, error) {
+	sample, err := recordSample(ctx, c, detectDuration)
+	if err != nil {
+		return "", fmt.Errorf("Could not record a sample to detect the language of: %v", err)
+	}
+	var client *speech.Client
+	err = retryStartup(ctx, "create speech client", opts.startRetries, func() (err error) {
+		client, err = speech.NewClient(ctx)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+	return detectSampleLanguage(ctx, client, sample, encoding, languages), nil
+}
+
+// detectSampleLanguage recognizes sample in each of languages with client,
+// and returns the one recognized with the highest confidence, or "" if none
+// of them recognized anything. Temporary errors are retried like those of
+// the recognizer when starting.
+func detectSampleLanguage(ctx context.Context, client recognizeClient, sample []byte, encoding speechpb.RecognitionConfig_AudioEncoding, languages []string) string {
+	// the speech api can only recognize one language at a time, so the
+	// sample is recognized in all of them at once.
+	confidences := make([]float32, len(languages))
+	errs := make([]error, len(languages))
+	var wg sync.WaitGroup
+	for i, language := range languages {
+		wg.Add(1)
+		go func(i int, language string) {
+			defer wg.Done()
+			var resp *speechpb.RecognizeResponse
+			err := retryStartup(ctx, "detect the language in "+language, opts.startRetries, func() (err error) {
+				resp, err = client.Recognize(ctx, &speechpb.RecognizeRequest{
+					Config: &speechpb.RecognitionConfig{
+						LanguageCode:    language,
+						Encoding:        encoding,
+						SampleRateHertz: int32(opts.sampleRate),
+					},
+					Audio: &speechpb.RecognitionAudio{
+						AudioSource: &speechpb.RecognitionAudio_Content{Content: sample},
+					},
+				})
+				return err
+			})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			for _, result := range resp.Results {
+				if alt := bestAlternative(result.Alternatives); alt != nil && alt.Transcript != "" {
+					debugf("detecting language, %s heard '%s' with confidence %.2f", language, alt.Transcript, alt.Confidence)
+					confidences[i] = alt.Confidence
+					break
+				}
+			}
+		}(i, language)
+	}
+	wg.Wait()
+
+	best := ""
+	var confidence float32
+	for i, language := range languages {
+		if errs[i] != nil {
+			warnf("Could not recognize the sample in %s: %v", language, errs[i])
+			continue
+		}
+		if confidences[i] > confidence {
+			best, confidence = language, confidences[i]
+		}
+	}
+	return best
+}
+
+// recordSample records d of audio from the microphone, with the same
+// command as capture, or reads it from the start of the input file.
+func recordSample(ctx context.Context, c codec, d time.Duration) ([]byte, error) {
+	if opts.input != "" {
+		file, err := os.Open(opts.input)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		size := int64(d.Seconds() * float64(opts.sampleRate*c.sampleSize*opts.channels))
+		return ioutil.ReadAll(io.LimitReader(file, size))
+	}
+	path, err := exec.LookPath(opts.soxPath)
+	if err != nil {
+		return nil, err
+	}
+	args, err := captureCommandArgs(c)
+	if err != nil {
+		return nil, err
+	}
+	infof("detecting the language, say something")
+	args = append(args, "trim", "0", strconv.FormatFloat(d.Seconds(), 'f', -1, 64))
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
+
+// detectLanguages parses the comma separated languages of
+// --detect-language.
+func detectLanguages(s string) []string {
+	var languages []string
+	for _, language := range strings.Split(s, ",") {
+		if language = strings.TrimSpace(language); language != "" {
+			languages = append(languages, language)
+		}
+	}
+	return languages
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/googleapis/gax-go"
+	"github.com/slaskis/cloud-echo/echo/echotest"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeRecognizeClient recognizes the alternatives of each language, after
+// failing with its errors.
+type fakeRecognizeClient struct {
+	alternatives map[string][]*speechpb.SpeechRecognitionAlternative
+	errors       map[string][]error
+
+	mu       sync.Mutex
+	requests []*speechpb.RecognizeRequest
+}
+
+func (c *fakeRecognizeClient) Recognize(ctx context.Context, req *speechpb.RecognizeRequest, opts ...gax.CallOption) (*speechpb.RecognizeResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, req)
+	language := req.Config.LanguageCode
+	if errs := c.errors[language]; len(errs) > 0 {
+		c.errors[language] = errs[1:]
+		return nil, errs[0]
+	}
+	resp := &speechpb.RecognizeResponse{}
+	if alts := c.alternatives[language]; alts != nil {
+		resp.Results = []*speechpb.SpeechRecognitionResult{{Alternatives: alts}}
+	}
+	return resp, nil
+}
+
+func TestDetectSampleLanguage(t *testing.T) {
+	temporary := status.Error(codes.Unavailable, "try again")
+	cases := []struct {
+		name         string
+		alternatives map[string][]*speechpb.SpeechRecognitionAlternative
+		errors       map[string][]error
+		want         string
+		requests     int
+	}{
+		{"most confident", map[string][]*speechpb.SpeechRecognitionAlternative{
+			"en-US": {alternative("hey", 0.4)},
+			"sv-SE": {alternative("hej", 0.8), alternative("hey", 0.9)},
+		}, nil, "sv-SE", 2},
+		{"nothing heard", map[string][]*speechpb.SpeechRecognitionAlternative{
+			"en-US": {alternative("", 0.9)},
+		}, nil, "", 2},
+		{"failed", map[string][]*speechpb.SpeechRecognitionAlternative{
+			"en-US": {alternative("hey", 0.4)},
+			"sv-SE": {alternative("hej", 0.8)},
+		}, map[string][]error{
+			"sv-SE": {status.Error(codes.InvalidArgument, "bad config")},
+		}, "en-US", 2},
+		{"retried", map[string][]*speechpb.SpeechRecognitionAlternative{
+			"en-US": {alternative("hey", 0.4)},
+			"sv-SE": {alternative("hej", 0.8)},
+		}, map[string][]error{
+			"sv-SE": {temporary},
+		}, "sv-SE", 3},
+		{"retries exhausted", map[string][]*speechpb.SpeechRecognitionAlternative{
+			"en-US": {alternative("hey", 0.4)},
+			"sv-SE": {alternative("hej", 0.8)},
+		}, map[string][]error{
+			"sv-SE": {temporary, temporary},
+		}, "en-US", 3},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setOpts(t, func(o *options) {
+				o.sampleRate = 16000
+				o.startRetries = 1
+			})
+			clk := echotest.NewClock(time.Unix(0, 0))
+			useClock(t, clk)
+			client := &fakeRecognizeClient{alternatives: c.alternatives, errors: map[string][]error{}}
+			for language, errs := range c.errors {
+				client.errors[language] = errs
+			}
+			retried := len(c.errors["sv-SE"]) > 0 && c.errors["sv-SE"][0] == temporary
+			detected := make(chan string)
+			go func() {
+				detected <- detectSampleLanguage(context.Background(), client, []byte("sample"), speechpb.RecognitionConfig_LINEAR16, []string{"en-US", "sv-SE"})
+			}()
+			if retried {
+				clk.Wait(1)
+				clk.Advance(time.Second)
+			}
+			if got := <-detected; got != c.want {
+				t.Errorf("detected %q, want %q", got, c.want)
+			}
+			if len(client.requests) != c.requests {
+				t.Errorf("made %d requests, want %d", len(client.requests), c.requests)
+			}
+			for _, req := range client.requests {
+				if req.Config.Encoding != speechpb.RecognitionConfig_LINEAR16 || req.Config.SampleRateHertz != 16000 || string(req.Audio.GetContent()) != "sample" {
+					t.Errorf("unexpected request %v", req)
+				}
+			}
+		})
+	}
+}
+
+func TestCaptureCommandArgs(t *testing.T) {
+	cases := []struct {
+		name        string
+		effects     string
+		captureArgs string
+		want        []string
+		err         error
+	}{
+		{"default", "", "", []string{"-d", "-r", "16000", "-c", "1", "-t", "raw", "-e", "signed", "-b", "16", "-L", "-"}, nil},
+		{"effects", "highpass 100 gain -n", "", []string{"-d", "-r", "16000", "-c", "1", "-t", "raw", "-e", "signed", "-b", "16", "-L", "-", "highpass", "100", "gain", "-n"}, nil},
+		{"capture args", "", "-d -t raw -", []string{"-d", "-t", "raw", "-"}, nil},
+		{"invalid effects", "-n", "", nil, errors.New(`Invalid --sox-effects "-n", it must start with an effect`)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setOpts(t, func(o *options) {
+				o.sampleRate = 16000
+				o.channels = 1
+				o.soxEffects = c.effects
+				o.captureArgs = c.captureArgs
+			})
+			got, err := captureCommandArgs(codecs["linear16"])
+			if !reflect.DeepEqual(err, c.err) {
+				t.Fatalf("got error %v, want %v", err, c.err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestRecordSampleInput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "input.raw")
+	if err := ioutil.WriteFile(path, make([]byte, 10000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	setOpts(t, func(o *options) {
+		o.input = path
+		o.sampleRate = 1000
+		o.channels = 1
+	})
+	sample, err := recordSample(context.Background(), codecs["linear16"], 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sample) != 6000 {
+		t.Errorf("sampled %d bytes, want 6000", len(sample))
+	}
+}
@@ -0,0 +1,47 @@
+package echo
+
+import "time"
+
+// Clock tells the time and waits for it, so that what depends on it can be
+// tested with a fake one.
+type Clock interface {
+	Now() time.Time
+	// After sends the time on the returned channel once d has passed.
+	After(d time.Duration) <-chan time.Time
+	// AfterFunc calls f once d has passed, unless the returned Timer is
+	// stopped first.
+	AfterFunc(d time.Duration, f func()) Timer
+	// NewTicker sends the time on the channel of the returned Ticker every
+	// d, dropping ticks that aren't received in time.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a timer started by Clock.AfterFunc.
+type Timer interface {
+	// Stop stops the timer, and reports false if it had already fired or
+	// been stopped.
+	Stop() bool
+}
+
+// Ticker is a ticker started by Clock.NewTicker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// SystemClock is the Clock of the system.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                            { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time    { return time.After(d) }
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+func (systemClock) NewTicker(d time.Duration) Ticker          { return systemTicker{time.NewTicker(d)} }
+
+type systemTicker struct {
+	t *time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time { return t.t.C }
+func (t systemTicker) Stop()               { t.t.Stop() }
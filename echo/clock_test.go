@@ -0,0 +1,114 @@
+package echo
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock whose timers only expire when a test fires them.
+// The stages only wait with After.
+type fakeClock struct {
+	Clock
+	// timers receives a timer for each call to After.
+	timers chan fakeTimer
+}
+
+type fakeTimer struct {
+	d time.Duration
+	c chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{timers: make(chan fakeTimer, 16)}
+}
+
+func (c *fakeClock) Now() time.Time { return time.Time{} }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	t := fakeTimer{d, make(chan time.Time, 1)}
+	c.timers <- t
+	return t.c
+}
+
+// step is one step of a test of a stage of the results: a result sent to
+// it, a wait for it to start a timer of d, the expiry of the last timer, a
+// result it should send, or the end of its input.
+type step struct {
+	in     *Result
+	timer  time.Duration
+	expire bool
+	want   *Result
+	close  bool
+}
+
+// play runs the steps against a stage started with start, and checks that
+// it sends nothing more once its input has ended.
+func play(t *testing.T, start func(context.Context, <-chan Result, Clock) <-chan Result, steps []step) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clock := newFakeClock()
+	in := make(chan Result)
+	out := start(ctx, in, clock)
+	var last fakeTimer
+	closed := false
+	for i, s := range steps {
+		timeout := time.After(time.Second)
+		switch {
+		case s.in != nil:
+			select {
+			case in <- *s.in:
+			case <-timeout:
+				t.Fatalf("step %d: timed out sending %q", i, s.in.Transcript)
+			}
+		case s.timer > 0:
+			select {
+			case last = <-clock.timers:
+				if last.d != s.timer {
+					t.Errorf("step %d: got a timer of %s, want %s", i, last.d, s.timer)
+				}
+			case <-timeout:
+				t.Fatalf("step %d: timed out waiting for a timer", i)
+			}
+		case s.expire:
+			last.c <- time.Time{}
+		case s.want != nil:
+			select {
+			case res := <-out:
+				if !reflect.DeepEqual(res, *s.want) {
+					t.Errorf("step %d: got %+v, want %+v", i, res, *s.want)
+				}
+			case <-timeout:
+				t.Fatalf("step %d: timed out waiting for %q", i, s.want.Transcript)
+			}
+		case s.close:
+			close(in)
+			closed = true
+		}
+	}
+	if !closed {
+		close(in)
+	}
+	select {
+	case res, ok := <-out:
+		if ok {
+			t.Errorf("got %+v after the input ended, want nothing", res)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the output to end")
+	}
+}
+
+func interimResult(text string) *Result {
+	return &Result{Transcript: text}
+}
+
+func finalResult(text string, confidence float32, at time.Duration, words ...string) *Result {
+	res := &Result{Transcript: text, Confidence: confidence, IsFinal: true, Timestamp: time.Time{}.Add(at)}
+	for _, w := range words {
+		res.Words = append(res.Words, Word{Word: w})
+	}
+	return res
+}
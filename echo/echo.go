@@ -0,0 +1,528 @@
+// Package echo recognizes speech and speaks it back, possibly in another
+// language or voice.
+//
+// An Echo pipes audio to a Recognizer, turns each transcript into speech
+// with a Synthesizer and outputs the speech with a Writer, in the order it
+// was recognized.
+package echo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Result is a transcript of recognized speech.
+type Result struct {
+	Transcript string    `json:"transcript"`
+	Confidence float32   `json:"confidence"`
+	IsFinal    bool      `json:"is_final"`
+	Timestamp  time.Time `json:"timestamp"`
+	// Language is the language code of the transcript, if known.
+	Language string `json:"language,omitempty"`
+	// Channel is the audio channel the speech was recognized in, counting
+	// from 1, or 0 if the audio only has one.
+	Channel int `json:"channel,omitempty"`
+	// Alternatives are the transcripts the speech could also be, including
+	// Transcript itself, if the recognizer returned more than one.
+	Alternatives []Alternative `json:"alternatives,omitempty"`
+	// Words are the words of Transcript with the times they were spoken,
+	// if the recognizer returned them. Only final results have them.
+	Words []Word `json:"words,omitempty"`
+}
+
+// Word is a word of a transcript, with when it was spoken in seconds from
+// the start of the audio of the recognizer's session.
+type Word struct {
+	Word  string  `json:"word"`
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+// Alternative is one of the transcripts recognized for some speech.
+type Alternative struct {
+	Transcript string  `json:"transcript"`
+	Confidence float32 `json:"confidence"`
+}
+
+// Recognizer turns a stream of audio into transcripts.
+type Recognizer interface {
+	// SendAudio sends a chunk of audio to be recognized.
+	SendAudio(audio []byte) error
+	// CloseSend signals that no more audio will be sent.
+	CloseSend() error
+	// Results returns the transcripts as they are recognized. The channel
+	// is closed once the recognizer is done.
+	Results() <-chan Result
+	// Err returns the error that stopped the recognizer, if any. It should
+	// only be called after Results has been closed.
+	Err() error
+}
+
+// Synthesizer turns text into an audio stream.
+type Synthesizer interface {
+	Synthesize(ctx context.Context, text string) (io.ReadCloser, error)
+}
+
+// Translator translates text into another language.
+type Translator interface {
+	Translate(ctx context.Context, text string) (string, error)
+}
+
+// Writer outputs the synthesized speech of a transcript.
+type Writer interface {
+	WriteSpeech(text string, audio io.Reader) error
+}
+
+// Interrupter is implemented by Writers that can stop writing the speech
+// they're writing, such as when it's being played.
+type Interrupter interface {
+	Interrupt()
+}
+
+// WriterFunc is a function used as a Writer.
+type WriterFunc func(text string, audio io.Reader) error
+
+// WriteSpeech implements Writer.
+func (f WriterFunc) WriteSpeech(text string, audio io.Reader) error {
+	return f(text, audio)
+}
+
+// CountingReader counts the bytes read from R in N.
+type CountingReader struct {
+	R io.Reader
+	N int
+}
+
+// Read implements io.Reader.
+func (r *CountingReader) Read(p []byte) (int, error) {
+	n, err := r.R.Read(p)
+	r.N += n
+	return n, err
+}
+
+// Logger logs what goes on in the pipeline.
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// Tracer traces the stages that each utterance goes through.
+type Tracer interface {
+	// Start starts a span, as a child of the span in ctx if there's one,
+	// and returns a context with the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a traced stage of the pipeline.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	End()
+}
+
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(key string, value interface{}) {}
+func (nopSpan) End()                                       {}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, v ...interface{}) {}
+func (nopLogger) Infof(format string, v ...interface{})  {}
+func (nopLogger) Warnf(format string, v ...interface{})  {}
+func (nopLogger) Errorf(format string, v ...interface{}) {}
+
+// Echo speaks back the speech it recognizes. Only Recognizer and
+// Synthesizer are required.
+type Echo struct {
+	Recognizer  Recognizer
+	Synthesizer Synthesizer
+	// SynthesizerFor, when set, returns the synthesizer to speak the
+	// transcripts of a language with. It's not used for translated
+	// transcripts, or those without a language.
+	SynthesizerFor func(language string) (Synthesizer, error)
+	// Writer outputs the speech, it's discarded when nil.
+	Writer Writer
+	// WriterFor, when set, returns the Writer for the speech of the
+	// transcripts of a channel. It's not used for channel 0.
+	WriterFor func(channel int) Writer
+	// Translator, when set, translates the transcripts before they're
+	// synthesized. Transcripts that fail to translate are skipped.
+	Translator Translator
+	// Wrap, when set, turns the text into what's synthesized, such as by
+	// wrapping it in ssml.
+	Wrap func(text string) (string, error)
+	// OnResult, when set, is called with every result that is echoed.
+	OnResult func(Result) error
+	// OnWritten, when set, is called with the result of each utterance
+	// once its speech has been written. It's not called for utterances
+	// that are skipped.
+	OnWritten func(Result)
+	// Logger defaults to not logging anything.
+	Logger Logger
+	// Tracer, when set, traces a span per utterance from its recognition
+	// until its speech has been written. The context passed to the
+	// Translator and Synthesizer has the span of the utterance.
+	Tracer Tracer
+	// Clock, when set, is what the echo waits with for SpeechTimeout and
+	// SegmentGap, by default SystemClock.
+	Clock Clock
+
+	// ChunkSize is how many bytes of audio to send at a time, by default
+	// 1024.
+	ChunkSize int
+	// Interim echoes interim results too, not only final ones.
+	Interim bool
+	// MinConfidence skips final results with a lower confidence.
+	MinConfidence float64
+	// DedupWindow skips a final result that repeats the previous one
+	// within this long.
+	DedupWindow time.Duration
+	// SpeechTimeout, when set, makes the last interim result final when
+	// nothing else has been recognized in this long, rather than waiting
+	// for the Recognizer to decide that the utterance has ended. The
+	// Recognizer must return interim results.
+	SpeechTimeout time.Duration
+	// SegmentGap, when set, joins final results that follow each other
+	// within this long into one utterance, which is echoed once nothing
+	// else has been recognized for as long.
+	SegmentGap time.Duration
+	// Single stops after echoing the first final result.
+	Single bool
+	// Concurrency is how many transcripts to synthesize at the same time,
+	// by default 1.
+	Concurrency int
+	// BargeIn interrupts the speech being written when new speech is
+	// recognized, if the Writer is an Interrupter. The Recognizer should
+	// return interim results so that it's noticed as soon as possible.
+	BargeIn bool
+	// QueueSize is how many transcripts may wait to be synthesized. When
+	// the queue is full the oldest transcript is dropped, so that
+	// recognition never waits for synthesis. With 0 recognition waits.
+	QueueSize int
+}
+
+type utterance struct {
+	result   Result
+	ctx      context.Context
+	span     Span
+	text     string
+	input    string
+	language string
+	channel  int
+	audio    io.ReadCloser
+}
+
+// Run echoes the audio read from r until r ends and all of its speech has
+// been output, or ctx is cancelled.
+//
+// Once r ends no transcript is lost: each stage closes its output only
+// after its input has been closed and drained, from the Recognizer's
+// results through the queue of transcripts and the pending speech to the
+// Writer, so Run returns after the last of them has been written.
+func (e *Echo) Run(ctx context.Context, r io.Reader) error {
+	log := e.Logger
+	if log == nil {
+		log = nopLogger{}
+	}
+	size := e.ChunkSize
+	if size <= 0 {
+		size = 1024
+	}
+	concurrency := e.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	tracer := e.Tracer
+	if tracer == nil {
+		tracer = nopTracer{}
+	}
+	clock := e.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+
+	g, ctx := newGroup(ctx)
+
+	// stop ends the input early, letting the rest of the pipeline drain.
+	stopped := make(chan struct{})
+	var once sync.Once
+	stop := func() {
+		once.Do(func() { close(stopped) })
+	}
+
+	g.Go(func() error {
+		return pipeAudio(stopReader{r, stopped}, e.Recognizer, size, log)
+	})
+
+	// each transcript gets a channel for its synthesized audio, queued in
+	// the order they were recognized so that the output keeps that order
+	// while up to Concurrency of them are synthesized at once.
+	pending := make(chan chan utterance, concurrency-1)
+	workers := make(chan struct{}, concurrency)
+	// the transcripts waiting for a worker.
+	queueSize := e.QueueSize
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	queue := make(chan utterance, queueSize)
+
+	g.Go(func() error {
+		defer close(queue)
+		// the last final result of each channel.
+		last := make(map[int]Result)
+		interrupter, _ := e.Writer.(Interrupter)
+		results := e.Recognizer.Results()
+		if e.SpeechTimeout > 0 {
+			results = finalize(ctx, results, e.SpeechTimeout, clock)
+		}
+		if e.SegmentGap > 0 {
+			results = segment(ctx, results, e.SegmentGap, clock)
+		}
+		for res := range results {
+			if e.BargeIn && interrupter != nil {
+				interrupter.Interrupt()
+			}
+			if !res.IsFinal && !e.Interim {
+				continue
+			}
+			if res.IsFinal && float64(res.Confidence) < e.MinConfidence {
+				log.Infof("skipping '%s' with confidence %.2f", res.Transcript, res.Confidence)
+				continue
+			}
+			if res.IsFinal {
+				if isRepeat(last[res.Channel], res, e.DedupWindow) {
+					log.Infof("skipping repeated '%s'", res.Transcript)
+					continue
+				}
+				last[res.Channel] = res
+			}
+			if e.OnResult != nil {
+				if err := e.OnResult(res); err != nil {
+					return err
+				}
+			}
+			text := res.Transcript
+			language := res.Language
+			uctx, span := tracer.Start(ctx, "utterance")
+			span.SetAttribute("transcript.length", len(text))
+			if e.Translator != nil {
+				language = ""
+				translated, err := e.Translator.Translate(uctx, text)
+				if err != nil {
+					log.Errorf("Could not translate '%s': %v", text, err)
+					span.End()
+					continue
+				}
+				log.Debugf("translated '%s' to '%s'", text, translated)
+				text = translated
+			}
+			input := text
+			if e.Wrap != nil {
+				wrapped, err := e.Wrap(text)
+				if err != nil {
+					span.End()
+					return fmt.Errorf("Could not wrap transcript: %v", err)
+				}
+				input = wrapped
+			}
+			if err := enqueue(ctx, queue, utterance{result: res, ctx: uctx, span: span, text: text, input: input, language: language, channel: res.Channel}, log); err != nil {
+				span.End()
+				return err
+			}
+			if e.Single && res.IsFinal {
+				// stop the input and let the session finish, ignoring
+				// anything else it recognizes.
+				stop()
+				for range results {
+				}
+				break
+			}
+		}
+		if err := e.Recognizer.Err(); err != nil {
+			return RecognizeError{err}
+		}
+		return nil
+	})
+
+	g.Go(func() error {
+		defer close(pending)
+		for u := range queue {
+			select {
+			case workers <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			done := make(chan utterance, 1)
+			select {
+			case pending <- done:
+			case <-ctx.Done():
+				<-workers
+				return ctx.Err()
+			}
+			go func(u utterance) {
+				defer func() { <-workers }()
+				synth := e.Synthesizer
+				if e.SynthesizerFor != nil && u.language != "" {
+					s, err := e.SynthesizerFor(u.language)
+					if err != nil {
+						log.Errorf("No synthesizer for %s, skipping '%s': %v", u.language, u.text, err)
+						u.span.End()
+						done <- u
+						return
+					}
+					synth = s
+				}
+				audio, err := synth.Synthesize(u.ctx, u.input)
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Errorf("Could not synthesize '%s': %v", u.text, err)
+					}
+					u.span.End()
+				}
+				u.audio = audio
+				done <- u
+			}(u)
+		}
+		return nil
+	})
+
+	g.Go(func() error {
+		for done := range pending {
+			u := <-done
+			if u.audio == nil {
+				continue
+			}
+			if ctx.Err() != nil {
+				u.audio.Close()
+				u.span.End()
+				return ctx.Err()
+			}
+			err := e.write(tracer, u)
+			u.audio.Close()
+			u.span.End()
+			if err != nil {
+				return err
+			}
+			if e.OnWritten != nil {
+				e.OnWritten(u.result)
+			}
+		}
+		return nil
+	})
+
+	return g.Wait()
+}
+
+// write outputs the speech of u with the Writer.
+func (e *Echo) write(tracer Tracer, u utterance) error {
+	w := e.Writer
+	if e.WriterFor != nil && u.channel != 0 {
+		w = e.WriterFor(u.channel)
+	}
+	if w == nil {
+		return nil
+	}
+	_, span := tracer.Start(u.ctx, "write")
+	defer span.End()
+	audio := &CountingReader{R: u.audio}
+	err := w.WriteSpeech(u.text, audio)
+	span.SetAttribute("audio.bytes", audio.N)
+	if err != nil {
+		return OutputError{err}
+	}
+	return nil
+}
+
+// enqueue adds u to the queue. A buffered queue never blocks, instead the
+// oldest utterance in it is dropped to make room.
+func enqueue(ctx context.Context, queue chan utterance, u utterance, log Logger) error {
+	if cap(queue) == 0 {
+		select {
+		case queue <- u:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for {
+		select {
+		case queue <- u:
+			return nil
+		default:
+		}
+		select {
+		case old := <-queue:
+			log.Warnf("synthesis can't keep up, dropping '%s'", old.text)
+			old.span.End()
+		default:
+		}
+	}
+}
+
+// PipeAudio sends the audio read from r to rec in chunks of up to size
+// bytes, and closes the stream once r is exhausted.
+func PipeAudio(r io.Reader, rec Recognizer, size int) error {
+	return pipeAudio(r, rec, size, nopLogger{})
+}
+
+func pipeAudio(r io.Reader, rec Recognizer, size int, log Logger) error {
+	buf := make([]byte, size)
+	for {
+		n, err := r.Read(buf)
+		// a read may return data along with an error, so send it first.
+		if n > 0 {
+			if err := rec.SendAudio(buf[:n]); err != nil {
+				log.Warnf("Could not send audio: %v", err)
+			} else {
+				log.Debugf("sent %d bytes of audio", n)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// Nothing else to pipe, close the stream.
+			if err := rec.CloseSend(); err != nil {
+				return RecognizeError{fmt.Errorf("Could not close stream: %w", err)}
+			}
+			log.Infof("sent all the audio")
+			return nil
+		}
+		if err != nil {
+			rec.CloseSend()
+			return CaptureError{fmt.Errorf("Could not read audio: %w", err)}
+		}
+	}
+}
+
+// isRepeat reports whether res is the same transcript as last within window.
+func isRepeat(last, res Result, window time.Duration) bool {
+	if window <= 0 || res.Timestamp.Sub(last.Timestamp) > window {
+		return false
+	}
+	return strings.EqualFold(strings.TrimSpace(last.Transcript), strings.TrimSpace(res.Transcript))
+}
+
+// stopReader reads from r until stopped is closed.
+type stopReader struct {
+	r       io.Reader
+	stopped <-chan struct{}
+}
+
+func (r stopReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.stopped:
+		return 0, io.EOF
+	default:
+		return r.r.Read(p)
+	}
+}
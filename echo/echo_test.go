@@ -0,0 +1,547 @@
+package echo_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/slaskis/cloud-echo/echo"
+	"github.com/slaskis/cloud-echo/echo/echotest"
+)
+
+// fileWriter writes each utterance to a numbered file in dir.
+func fileWriter(dir string) echo.Writer {
+	n := 0
+	return echo.WriterFunc(func(text string, audio io.Reader) error {
+		n++
+		file, err := os.Create(filepath.Join(dir, fmt.Sprintf("%02d.txt", n)))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(file, audio)
+		return err
+	})
+}
+
+func final(text string) echo.Result {
+	return echo.Result{Transcript: text, Confidence: 0.9, IsFinal: true}
+}
+
+// finalAt is a final result recognized s seconds in.
+func finalAt(text string, s int64) echo.Result {
+	res := final(text)
+	res.Timestamp = time.Unix(s, 0)
+	return res
+}
+
+func TestRun(t *testing.T) {
+	failed := errors.New("recognizer failed")
+	tests := []struct {
+		name    string
+		echo    echo.Echo
+		results []echo.Result
+		err     error
+		synth   []string
+		speech  []string
+	}{
+		{
+			name:    "finals",
+			results: []echo.Result{{Transcript: "hel"}, final("hello"), final("world")},
+			synth:   []string{"hello", "world"},
+			speech:  []string{"hello", "world"},
+		},
+		{
+			name:    "interim",
+			echo:    echo.Echo{Interim: true},
+			results: []echo.Result{{Transcript: "hel"}, final("hello")},
+			synth:   []string{"hel", "hello"},
+			speech:  []string{"hel", "hello"},
+		},
+		{
+			name:    "min confidence",
+			echo:    echo.Echo{MinConfidence: 0.95},
+			results: []echo.Result{final("hello"), {Transcript: "sure", Confidence: 0.99, IsFinal: true}},
+			synth:   []string{"sure"},
+			speech:  []string{"sure"},
+		},
+		{
+			name:    "wrap",
+			echo:    echo.Echo{Wrap: func(text string) (string, error) { return "<speak>" + text + "</speak>", nil }},
+			results: []echo.Result{final("hello")},
+			synth:   []string{"<speak>hello</speak>"},
+			speech:  []string{"<speak>hello</speak>"},
+		},
+		{
+			name:    "single",
+			echo:    echo.Echo{Single: true},
+			results: []echo.Result{final("hello"), final("world")},
+			synth:   []string{"hello"},
+			speech:  []string{"hello"},
+		},
+		{
+			name:    "concurrency keeps the order",
+			echo:    echo.Echo{Concurrency: 3},
+			results: []echo.Result{final("one"), final("two"), final("three"), final("four")},
+			synth:   []string{"one", "two", "three", "four"},
+			speech:  []string{"one", "two", "three", "four"},
+		},
+		{
+			name: "dedup window",
+			echo: echo.Echo{DedupWindow: 2 * time.Second},
+			results: []echo.Result{
+				finalAt("hello", 0),
+				finalAt("Hello ", 1),
+				finalAt("hello", 4),
+				finalAt("world", 5),
+				finalAt("hello", 6),
+			},
+			synth:  []string{"hello", "hello", "world", "hello"},
+			speech: []string{"hello", "hello", "world", "hello"},
+		},
+		{
+			name: "dedup window per channel",
+			echo: echo.Echo{DedupWindow: 2 * time.Second},
+			results: []echo.Result{
+				finalAt("hello", 0),
+				{Transcript: "hello", Confidence: 0.9, IsFinal: true, Channel: 1, Timestamp: time.Unix(1, 0)},
+				finalAt("hello", 1),
+			},
+			synth:  []string{"hello", "hello"},
+			speech: []string{"hello", "hello"},
+		},
+		{
+			name:    "no dedup window",
+			results: []echo.Result{finalAt("hello", 0), finalAt("hello", 0)},
+			synth:   []string{"hello", "hello"},
+			speech:  []string{"hello", "hello"},
+		},
+		{
+			name:    "recognizer error",
+			results: []echo.Result{final("hello")},
+			err:     failed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			rec := echotest.NewRecognizer(tt.err, tt.results...)
+			defer rec.Close()
+			synth := &echotest.Synthesizer{}
+			e := tt.echo
+			e.Recognizer = rec
+			e.Synthesizer = synth
+			e.Writer = fileWriter(dir)
+
+			err := e.Run(context.Background(), strings.NewReader("some audio"))
+			if tt.err == nil && err != nil {
+				t.Fatalf("Run() = %v", err)
+			}
+			if tt.err != nil {
+				var recognize echo.RecognizeError
+				if !errors.Is(err, tt.err) || !errors.As(err, &recognize) {
+					t.Fatalf("Run() = %v, want a RecognizeError of %v", err, tt.err)
+				}
+			}
+			if got := string(rec.Audio()); got != "some audio" {
+				t.Errorf("sent audio %q, want %q", got, "some audio")
+			}
+			if tt.err != nil {
+				// what's left of the pipeline is cancelled.
+				return
+			}
+			// concurrent syntheses start in any order, their speech is
+			// written in order.
+			got := synth.Texts()
+			sort.Strings(got)
+			want := append([]string(nil), tt.synth...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("synthesized %q, want %q", got, want)
+			}
+			if got := readFiles(t, dir); !reflect.DeepEqual(got, tt.speech) {
+				t.Errorf("wrote %q, want %q", got, tt.speech)
+			}
+		})
+	}
+}
+
+func readFiles(t *testing.T, dir string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var speech []string
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		speech = append(speech, string(b))
+	}
+	return speech
+}
+
+func TestRunSkipsFailedSynthesis(t *testing.T) {
+	rec := echotest.NewRecognizer(nil, final("hello"), final("broken"), final("world"))
+	defer rec.Close()
+	synth := &echotest.Synthesizer{Errors: map[string]error{"broken": errors.New("no voice")}}
+	w := &echotest.Writer{}
+	e := &echo.Echo{Recognizer: rec, Synthesizer: synth, Writer: w}
+	if err := e.Run(context.Background(), strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := w.Speech(), []string{"hello", "world"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+}
+
+func TestRunOnWritten(t *testing.T) {
+	rec := echotest.NewRecognizer(nil, final("hello"), final("broken"), final("world"))
+	defer rec.Close()
+	synth := &echotest.Synthesizer{Errors: map[string]error{"broken": errors.New("no voice")}}
+	w := &echotest.Writer{}
+	var written []string
+	e := &echo.Echo{
+		Recognizer:  rec,
+		Synthesizer: synth,
+		Writer: echo.WriterFunc(func(text string, audio io.Reader) error {
+			if len(written) != len(w.Speech()) {
+				t.Errorf("'%s' is written after OnWritten was called for %q", text, written)
+			}
+			return w.WriteSpeech(text, audio)
+		}),
+		OnWritten: func(res echo.Result) {
+			written = append(written, res.Transcript)
+		},
+	}
+	if err := e.Run(context.Background(), strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"hello", "world"}; !reflect.DeepEqual(written, want) {
+		t.Errorf("OnWritten called with %q, want %q", written, want)
+	}
+}
+
+// slowSynthesizer takes a while to synthesize each text.
+type slowSynthesizer struct {
+	echo.Synthesizer
+	delay time.Duration
+}
+
+func (s slowSynthesizer) Synthesize(ctx context.Context, text string) (io.ReadCloser, error) {
+	time.Sleep(s.delay)
+	return s.Synthesizer.Synthesize(ctx, text)
+}
+
+func TestRunDrains(t *testing.T) {
+	var results []echo.Result
+	var want []string
+	for i := 0; i < 20; i++ {
+		text := fmt.Sprintf("utterance %d", i)
+		results = append(results, finalAt(text, int64(i*10)))
+		want = append(want, text)
+	}
+	tests := []struct {
+		name string
+		echo echo.Echo
+	}{
+		{name: "sequential"},
+		{name: "concurrent", echo: echo.Echo{Concurrency: 4}},
+		{name: "segment gap", echo: echo.Echo{SegmentGap: time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := echotest.NewRecognizer(nil, results...)
+			defer rec.Close()
+			w := &echotest.Writer{}
+			e := tt.echo
+			e.Recognizer = rec
+			e.Synthesizer = slowSynthesizer{&echotest.Synthesizer{}, time.Millisecond}
+			e.Writer = echo.WriterFunc(func(text string, audio io.Reader) error {
+				time.Sleep(time.Millisecond)
+				return w.WriteSpeech(text, audio)
+			})
+			// the results all come once the input has ended.
+			if err := e.Run(context.Background(), strings.NewReader("some audio")); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.Speech(); !reflect.DeepEqual(got, want) {
+				t.Errorf("wrote %q when Run returned, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRunOutputError(t *testing.T) {
+	rec := echotest.NewRecognizer(nil, final("hello"), final("world"))
+	defer rec.Close()
+	failed := errors.New("disk full")
+	e := &echo.Echo{
+		Recognizer:  rec,
+		Synthesizer: &echotest.Synthesizer{},
+		Writer: echo.WriterFunc(func(text string, audio io.Reader) error {
+			return failed
+		}),
+	}
+	err := e.Run(context.Background(), strings.NewReader(""))
+	var output echo.OutputError
+	if !errors.Is(err, failed) || !errors.As(err, &output) {
+		t.Fatalf("Run() = %v, want an OutputError of %v", err, failed)
+	}
+}
+
+// chanRecognizer is a Recognizer whose results are sent by the test.
+type chanRecognizer struct {
+	results chan echo.Result
+}
+
+func (r *chanRecognizer) SendAudio(audio []byte) error { return nil }
+func (r *chanRecognizer) CloseSend() error             { return nil }
+func (r *chanRecognizer) Results() <-chan echo.Result  { return r.results }
+func (r *chanRecognizer) Err() error                   { return nil }
+
+// interruptWriter writes until it's interrupted.
+type interruptWriter struct {
+	writing     chan struct{}
+	interrupted chan struct{}
+}
+
+func (w *interruptWriter) WriteSpeech(text string, audio io.Reader) error {
+	close(w.writing)
+	select {
+	case <-w.interrupted:
+	case <-time.After(5 * time.Second):
+	}
+	return nil
+}
+
+func (w *interruptWriter) Interrupt() {
+	select {
+	case <-w.interrupted:
+	default:
+		close(w.interrupted)
+	}
+}
+
+func TestBargeIn(t *testing.T) {
+	rec := &chanRecognizer{results: make(chan echo.Result)}
+	w := &interruptWriter{writing: make(chan struct{}), interrupted: make(chan struct{})}
+	e := &echo.Echo{Recognizer: rec, Synthesizer: &echotest.Synthesizer{}, Writer: w, BargeIn: true}
+
+	go func() {
+		defer close(rec.results)
+		rec.results <- final("hello")
+		<-w.writing
+		rec.results <- echo.Result{Transcript: "hey"}
+	}()
+	errc := make(chan error, 1)
+	go func() { errc <- e.Run(context.Background(), strings.NewReader("")) }()
+
+	select {
+	case <-w.interrupted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the speech being written wasn't interrupted by the interim result")
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// chunkRecognizer keeps the size of each chunk of audio sent to it.
+type chunkRecognizer struct {
+	chunks []int
+	audio  []byte
+	closed bool
+}
+
+func (r *chunkRecognizer) SendAudio(audio []byte) error {
+	r.chunks = append(r.chunks, len(audio))
+	r.audio = append(r.audio, audio...)
+	return nil
+}
+func (r *chunkRecognizer) CloseSend() error            { r.closed = true; return nil }
+func (r *chunkRecognizer) Results() <-chan echo.Result { return nil }
+func (r *chunkRecognizer) Err() error                  { return nil }
+
+func TestPipeAudioChunkSize(t *testing.T) {
+	audio := strings.Repeat("x", 2500)
+	tests := []struct {
+		size   int
+		chunks []int
+	}{
+		{1024, []int{1024, 1024, 452}},
+		{2500, []int{2500}},
+		{4096, []int{2500}},
+		{1000, []int{1000, 1000, 500}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.size), func(t *testing.T) {
+			rec := &chunkRecognizer{}
+			if err := echo.PipeAudio(strings.NewReader(audio), rec, tt.size); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rec.chunks, tt.chunks) {
+				t.Errorf("sent chunks of %v, want %v", rec.chunks, tt.chunks)
+			}
+			if string(rec.audio) != audio || !rec.closed {
+				t.Errorf("sent %d bytes and closed %v, want all %d and closed", len(rec.audio), rec.closed, len(audio))
+			}
+		})
+	}
+}
+
+func BenchmarkPipeAudio(b *testing.B) {
+	audio := make([]byte, 1<<20)
+	for _, size := range []int{256, 1024, 4096, 32768} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			b.SetBytes(int64(len(audio)))
+			for i := 0; i < b.N; i++ {
+				echo.PipeAudio(bytes.NewReader(audio), nopRecognizer{}, size)
+			}
+		})
+	}
+}
+
+// nopRecognizer discards all the audio.
+type nopRecognizer struct{}
+
+func (nopRecognizer) SendAudio(audio []byte) error { return nil }
+func (nopRecognizer) CloseSend() error             { return nil }
+func (nopRecognizer) Results() <-chan echo.Result  { return nil }
+func (nopRecognizer) Err() error                   { return nil }
+
+// errReader returns its data along with err.
+type errReader struct {
+	data string
+	err  error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	if r.data == "" {
+		return n, r.err
+	}
+	return n, nil
+}
+
+func TestPipeAudioPartialReads(t *testing.T) {
+	broken := errors.New("device unplugged")
+	tests := []struct {
+		name  string
+		r     io.Reader
+		audio string
+		err   error
+	}{
+		{"one byte at a time", iotest.OneByteReader(strings.NewReader("hello")), "hello", nil},
+		{"half reads", iotest.HalfReader(strings.NewReader("hello world")), "hello world", nil},
+		{"data with eof", iotest.DataErrReader(strings.NewReader("hello")), "hello", nil},
+		{"unexpected eof", &errReader{"hello", io.ErrUnexpectedEOF}, "hello", nil},
+		{"data with an error", &errReader{"hello", broken}, "hello", broken},
+		{"error", iotest.ErrReader(broken), "", broken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &chunkRecognizer{}
+			err := echo.PipeAudio(tt.r, rec, 4)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("PipeAudio() = %v, want %v", err, tt.err)
+			}
+			var capture echo.CaptureError
+			if tt.err != nil && !errors.As(err, &capture) {
+				t.Errorf("PipeAudio() = %v, want a CaptureError", err)
+			}
+			if string(rec.audio) != tt.audio {
+				t.Errorf("sent %q, want %q", rec.audio, tt.audio)
+			}
+			if !rec.closed {
+				t.Error("the stream wasn't closed")
+			}
+		})
+	}
+}
+
+// blockedSynthesizer waits to synthesize text until it's released.
+type blockedSynthesizer struct {
+	echotest.Synthesizer
+	text    string
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockedSynthesizer) Synthesize(ctx context.Context, text string) (io.ReadCloser, error) {
+	if text == s.text {
+		close(s.started)
+		<-s.release
+	}
+	return s.Synthesizer.Synthesize(ctx, text)
+}
+
+// dropLogger counts the transcripts that are dropped.
+type dropLogger struct {
+	mu      sync.Mutex
+	dropped int
+}
+
+func (l *dropLogger) Debugf(format string, v ...interface{}) {}
+func (l *dropLogger) Infof(format string, v ...interface{})  {}
+func (l *dropLogger) Errorf(format string, v ...interface{}) {}
+func (l *dropLogger) Warnf(format string, v ...interface{}) {
+	if strings.Contains(format, "dropping") {
+		l.mu.Lock()
+		l.dropped++
+		l.mu.Unlock()
+	}
+}
+
+func TestQueueSize(t *testing.T) {
+	rec := &chanRecognizer{results: make(chan echo.Result)}
+	synth := &blockedSynthesizer{text: "one", started: make(chan struct{}), release: make(chan struct{})}
+	w := &echotest.Writer{}
+	log := &dropLogger{}
+	e := &echo.Echo{Recognizer: rec, Synthesizer: synth, Writer: w, Logger: log, QueueSize: 1}
+	errc := make(chan error, 1)
+	go func() { errc <- e.Run(context.Background(), strings.NewReader("")) }()
+
+	// recognition goes on while the synthesis of "one" is stuck.
+	texts := []string{"one", "two", "three", "four", "five"}
+	for i, text := range texts {
+		if i == 1 {
+			<-synth.started
+		}
+		select {
+		case rec.results <- final(text):
+		case <-time.After(2 * time.Second):
+			t.Fatalf("recognition waited for synthesis at '%s'", text)
+		}
+	}
+	close(rec.results)
+	close(synth.release)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	speech := w.Speech()
+	if len(speech) < 2 || speech[0] != "one" || speech[len(speech)-1] != "five" {
+		t.Fatalf("wrote %q, want the first and the last transcript", speech)
+	}
+	if len(speech)+log.dropped != len(texts) {
+		t.Errorf("wrote %q and dropped %d, want the rest of %q dropped", speech, log.dropped, texts)
+	}
+	if log.dropped == 0 {
+		t.Error("dropped nothing, with a queue of one")
+	}
+}
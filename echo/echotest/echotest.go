@@ -0,0 +1,270 @@
+// Package echotest provides fakes for testing code that uses an echo.Echo.
+package echotest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/slaskis/cloud-echo/echo"
+)
+
+// Recognizer is an echo.Recognizer that emits a scripted sequence of
+// results once all the audio has been sent.
+type Recognizer struct {
+	results chan echo.Result
+	script  []echo.Result
+	err     error
+	done    chan struct{}
+	stop    sync.Once
+
+	mu    sync.Mutex
+	audio bytes.Buffer
+	once  sync.Once
+}
+
+// NewRecognizer creates a Recognizer that emits results, and then stops
+// with err.
+func NewRecognizer(err error, results ...echo.Result) *Recognizer {
+	return &Recognizer{
+		results: make(chan echo.Result),
+		script:  results,
+		err:     err,
+		done:    make(chan struct{}),
+	}
+}
+
+// SendAudio implements echo.Recognizer.
+func (r *Recognizer) SendAudio(audio []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.audio.Write(audio)
+	return nil
+}
+
+// CloseSend implements echo.Recognizer.
+func (r *Recognizer) CloseSend() error {
+	r.once.Do(func() {
+		go func() {
+			defer close(r.results)
+			for _, res := range r.script {
+				select {
+				case r.results <- res:
+				case <-r.done:
+					return
+				}
+			}
+		}()
+	})
+	return nil
+}
+
+// Close stops sending the results that are left, for when they're no
+// longer read.
+func (r *Recognizer) Close() {
+	r.stop.Do(func() { close(r.done) })
+}
+
+// Results implements echo.Recognizer.
+func (r *Recognizer) Results() <-chan echo.Result {
+	return r.results
+}
+
+// Err implements echo.Recognizer.
+func (r *Recognizer) Err() error {
+	return r.err
+}
+
+// Audio returns all the audio sent so far.
+func (r *Recognizer) Audio() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]byte(nil), r.audio.Bytes()...)
+}
+
+// Synthesizer is an echo.Synthesizer that "synthesizes" the text itself,
+// or a canned error for the text in Errors.
+type Synthesizer struct {
+	Errors map[string]error
+
+	mu    sync.Mutex
+	texts []string
+}
+
+// Synthesize implements echo.Synthesizer.
+func (s *Synthesizer) Synthesize(ctx context.Context, text string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	s.texts = append(s.texts, text)
+	s.mu.Unlock()
+	if err := s.Errors[text]; err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewBufferString(text)), nil
+}
+
+// Texts returns the texts synthesized so far.
+func (s *Synthesizer) Texts() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.texts...)
+}
+
+// Writer is an echo.Writer that keeps what it's written in memory.
+type Writer struct {
+	mu     sync.Mutex
+	speech []string
+}
+
+// WriteSpeech implements echo.Writer.
+func (w *Writer) WriteSpeech(text string, audio io.Reader) error {
+	b, err := ioutil.ReadAll(audio)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.speech = append(w.speech, string(b))
+	return nil
+}
+
+// Speech returns the audio of each utterance written so far.
+func (w *Writer) Speech() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.speech...)
+}
+
+// Clock is an echo.Clock whose time only passes when it's advanced, so that
+// what waits for it can be tested without waiting.
+type Clock struct {
+	mu      sync.Mutex
+	changed *sync.Cond
+	now     time.Time
+	waiters []*waiter
+}
+
+// NewClock creates a Clock whose time is now.
+func NewClock(now time.Time) *Clock {
+	c := &Clock{now: now}
+	c.changed = sync.NewCond(&c.mu)
+	return c
+}
+
+// waiter is a timer or ticker of a Clock.
+type waiter struct {
+	clock *Clock
+	at    time.Time
+	every time.Duration
+	c     chan time.Time
+	f     func()
+}
+
+// Now implements echo.Clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After implements echo.Clock.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	return c.add(d, 0, nil).c
+}
+
+// AfterFunc implements echo.Clock. f is called by Advance.
+func (c *Clock) AfterFunc(d time.Duration, f func()) echo.Timer {
+	return c.add(d, 0, f)
+}
+
+// NewTicker implements echo.Clock.
+func (c *Clock) NewTicker(d time.Duration) echo.Ticker {
+	if d <= 0 {
+		panic("non-positive interval for echotest.Clock.NewTicker")
+	}
+	return ticker{c.add(d, d, nil)}
+}
+
+func (c *Clock) add(d, every time.Duration, f func()) *waiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := &waiter{clock: c, at: c.now.Add(d), every: every, c: make(chan time.Time, 1), f: f}
+	c.waiters = append(c.waiters, w)
+	c.changed.Broadcast()
+	return w
+}
+
+// Advance moves the time on by d, firing the timers and tickers that are
+// due on the way in the order they're due.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		var next *waiter
+		for _, w := range c.waiters {
+			if !w.at.After(end) && (next == nil || w.at.Before(next.at)) {
+				next = w
+			}
+		}
+		if next == nil {
+			break
+		}
+		c.now = next.at
+		if next.every > 0 {
+			next.at = next.at.Add(next.every)
+		} else {
+			c.remove(next)
+		}
+		if next.f != nil {
+			c.mu.Unlock()
+			next.f()
+			c.mu.Lock()
+			continue
+		}
+		select {
+		case next.c <- c.now:
+		default:
+		}
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// Wait blocks until n timers and tickers are waiting for the clock, so that
+// it can be advanced once another goroutine has started waiting.
+func (c *Clock) Wait(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.waiters) < n {
+		c.changed.Wait()
+	}
+}
+
+// remove stops w. It must be called with mu held.
+func (c *Clock) remove(w *waiter) bool {
+	for i, other := range c.waiters {
+		if other == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			c.changed.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+// Stop implements echo.Timer.
+func (w *waiter) Stop() bool {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+	return w.clock.remove(w)
+}
+
+// ticker is a waiter that fires every so often.
+type ticker struct {
+	w *waiter
+}
+
+func (t ticker) C() <-chan time.Time { return t.w.c }
+func (t ticker) Stop()               { t.w.Stop() }
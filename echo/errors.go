@@ -0,0 +1,38 @@
+package echo
+
+// The errors of the stages of an echo, so that a caller can tell with
+// errors.As which of them failed. Each reads as the error it wraps.
+
+// CaptureError is an error reading the audio to recognize.
+type CaptureError struct {
+	Err error
+}
+
+func (e CaptureError) Error() string { return e.Err.Error() }
+func (e CaptureError) Unwrap() error { return e.Err }
+
+// RecognizeError is an error of the Recognizer.
+type RecognizeError struct {
+	Err error
+}
+
+func (e RecognizeError) Error() string { return e.Err.Error() }
+func (e RecognizeError) Unwrap() error { return e.Err }
+
+// SynthesizeError is an error of a Synthesizer. Run skips a transcript
+// that can't be synthesized rather than return it, so it's only returned
+// by callers that set up a Synthesizer.
+type SynthesizeError struct {
+	Err error
+}
+
+func (e SynthesizeError) Error() string { return e.Err.Error() }
+func (e SynthesizeError) Unwrap() error { return e.Err }
+
+// OutputError is an error of the Writer.
+type OutputError struct {
+	Err error
+}
+
+func (e OutputError) Error() string { return e.Err.Error() }
+func (e OutputError) Unwrap() error { return e.Err }
@@ -0,0 +1,83 @@
+package echo
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// finalize passes on the results read from in, turning the last interim
+// result into a final one when nothing else has been recognized in timeout.
+// The results the recognizer sends for the rest of the utterance only pass
+// on the words they add to it.
+func finalize(ctx context.Context, in <-chan Result, timeout time.Duration, clock Clock) <-chan Result {
+	out := make(chan Result)
+	go func() {
+		defer close(out)
+		var interim *Result
+		var forced *Result
+		var expired <-chan time.Time
+		send := func(res Result) bool {
+			select {
+			case out <- res:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for {
+			select {
+			case res, ok := <-in:
+				if !ok {
+					return
+				}
+				expired = nil
+				if !res.IsFinal {
+					interim = &res
+					expired = clock.After(timeout)
+					if !send(res) {
+						return
+					}
+					continue
+				}
+				interim = nil
+				res, fresh := after(forced, res)
+				forced = nil
+				if fresh && !send(res) {
+					return
+				}
+			case <-expired:
+				expired = nil
+				res := *interim
+				res.IsFinal = true
+				interim = nil
+				rest, ok := after(forced, res)
+				forced = &res
+				if ok && !send(rest) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// after returns res without the words of forced, the result that was made
+// final early, as the transcript of an utterance starts over with every
+// result. It reports false if there's nothing new, or res rewords forced.
+func after(forced *Result, res Result) (Result, bool) {
+	if forced == nil || forced.Channel != res.Channel {
+		return res, true
+	}
+	if !strings.HasPrefix(res.Transcript, forced.Transcript) {
+		return res, false
+	}
+	res.Transcript = strings.TrimSpace(res.Transcript[len(forced.Transcript):])
+	res.Alternatives = nil
+	if n := len(strings.Fields(forced.Transcript)); len(res.Words) >= n {
+		res.Words = res.Words[n:]
+	}
+	return res, res.Transcript != ""
+}
@@ -0,0 +1,74 @@
+package echo
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFinalize(t *testing.T) {
+	const timeout = time.Second
+	hello := interimResult("hello")
+	forced := &Result{Transcript: "hello", IsFinal: true}
+	cases := []struct {
+		name  string
+		steps []step
+	}{
+		{"final in time", []step{
+			{in: hello}, {timer: timeout}, {want: hello},
+			{in: finalResult("hello world", 0.9, 0)},
+			{want: finalResult("hello world", 0.9, 0)},
+		}},
+		{"expired", []step{
+			{in: hello}, {timer: timeout}, {want: hello},
+			{expire: true}, {want: forced},
+		}},
+		{"rest of the utterance", []step{
+			{in: hello}, {timer: timeout}, {want: hello},
+			{expire: true}, {want: forced},
+			{in: interimResult("hello wor")}, {timer: timeout}, {want: interimResult("hello wor")},
+			{in: finalResult("hello world", 0.9, 0, "hello", "world")},
+			{want: finalResult("world", 0.9, 0, "world")},
+		}},
+		{"nothing new", []step{
+			{in: hello}, {timer: timeout}, {want: hello},
+			{expire: true}, {want: forced},
+			{in: finalResult("hello", 0.9, 0, "hello")},
+		}},
+		{"reworded", []step{
+			{in: hello}, {timer: timeout}, {want: hello},
+			{expire: true}, {want: forced},
+			{in: finalResult("yellow", 0.9, 0, "yellow")},
+		}},
+		{"expired again", []step{
+			{in: hello}, {timer: timeout}, {want: hello},
+			{expire: true}, {want: forced},
+			{in: interimResult("hello world")}, {timer: timeout}, {want: interimResult("hello world")},
+			{expire: true}, {want: &Result{Transcript: "world", IsFinal: true}},
+		}},
+		{"input ended", []step{
+			{in: hello}, {timer: timeout}, {want: hello},
+			{close: true},
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			play(t, func(ctx context.Context, in <-chan Result, clock Clock) <-chan Result {
+				return finalize(ctx, in, timeout, clock)
+			}, c.steps)
+		})
+	}
+}
+
+func TestFinalizeOtherChannel(t *testing.T) {
+	forced := &Result{Transcript: "hello", IsFinal: true, Channel: 1}
+	other := finalResult("hello there", 0.9, 0)
+	other.Channel = 2
+	play(t, func(ctx context.Context, in <-chan Result, clock Clock) <-chan Result {
+		return finalize(ctx, in, time.Second, clock)
+	}, []step{
+		{in: &Result{Transcript: "hello", Channel: 1}}, {timer: time.Second}, {want: &Result{Transcript: "hello", Channel: 1}},
+		{expire: true}, {want: forced},
+		{in: other}, {want: other},
+	})
+}
@@ -0,0 +1,82 @@
+package echo
+
+import (
+	"context"
+	"time"
+)
+
+// segment joins the final results read from in that follow each other
+// within gap into one, so that an utterance spoken with short pauses is
+// echoed at once. A joined result is sent once no other result has followed
+// it in gap, and has the lowest confidence of its parts. Interim results
+// are passed on as they are.
+func segment(ctx context.Context, in <-chan Result, gap time.Duration, clock Clock) <-chan Result {
+	out := make(chan Result)
+	go func() {
+		defer close(out)
+		var pending *Result
+		var expired <-chan time.Time
+		send := func(res Result) bool {
+			select {
+			case out <- res:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		flush := func() bool {
+			if pending == nil {
+				return true
+			}
+			res := *pending
+			pending = nil
+			expired = nil
+			return send(res)
+		}
+		for {
+			select {
+			case res, ok := <-in:
+				if !ok {
+					flush()
+					return
+				}
+				if !res.IsFinal {
+					if !send(res) {
+						return
+					}
+					continue
+				}
+				if pending != nil && (res.Channel != pending.Channel || res.Timestamp.Sub(pending.Timestamp) > gap) {
+					if !flush() {
+						return
+					}
+				}
+				if pending == nil {
+					pending = &res
+				} else {
+					pending.Transcript += " " + res.Transcript
+					if res.Confidence < pending.Confidence {
+						pending.Confidence = res.Confidence
+					}
+					pending.Timestamp = res.Timestamp
+					// the alternatives are of the parts, not the whole.
+					pending.Alternatives = nil
+					pending.Words = append(pending.Words, res.Words...)
+				}
+				// a new timer, so that a stale expiry of the old one is
+				// never received.
+				expired = clock.After(gap)
+			case <-expired:
+				expired = nil
+				res := *pending
+				pending = nil
+				if !send(res) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,54 @@
+package echo
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSegment(t *testing.T) {
+	const gap = 2 * time.Second
+	hello := finalResult("hello", 0.9, 0, "hello")
+	hello.Alternatives = []Alternative{{Transcript: "hello"}, {Transcript: "yellow"}}
+	world := finalResult("world", 0.8, time.Second, "world")
+	later := finalResult("world", 0.8, 3*time.Second, "world")
+	other := finalResult("world", 0.8, time.Second, "world")
+	other.Channel = 2
+	cases := []struct {
+		name  string
+		steps []step
+	}{
+		{"joined", []step{
+			{in: hello}, {timer: gap},
+			{in: world}, {timer: gap},
+			{expire: true},
+			{want: finalResult("hello world", 0.8, time.Second, "hello", "world")},
+		}},
+		{"after the gap", []step{
+			{in: hello}, {timer: gap},
+			{in: later}, {want: hello}, {timer: gap},
+			{expire: true}, {want: later},
+		}},
+		{"other channel", []step{
+			{in: hello}, {timer: gap},
+			{in: other}, {want: hello}, {timer: gap},
+			{expire: true}, {want: other},
+		}},
+		{"interim", []step{
+			{in: hello}, {timer: gap},
+			{in: interimResult("wor")}, {want: interimResult("wor")},
+			{expire: true}, {want: hello},
+		}},
+		{"input ended", []step{
+			{in: hello}, {timer: gap},
+			{close: true}, {want: hello},
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			play(t, func(ctx context.Context, in <-chan Result, clock Clock) <-chan Result {
+				return segment(ctx, in, gap, clock)
+			}, c.steps)
+		})
+	}
+}
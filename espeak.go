@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// EspeakSynthesizer synthesizes speech locally with espeak-ng, for when
+// there's no network. The audio is always wav.
+type EspeakSynthesizer struct {
+	path  string
+	voice string
+}
+
+// NewEspeakSynthesizer creates a Synthesizer speaking with the given espeak
+// voice, which may be a language such as "sv".
+func NewEspeakSynthesizer(voice string) (*EspeakSynthesizer, error) {
+	path, err := exec.LookPath("espeak-ng")
+	if err != nil {
+		return nil, fmt.Errorf("Could not find espeak-ng, is it installed? %v", err)
+	}
+	return &EspeakSynthesizer{
+		path:  path,
+		voice: voice,
+	}, nil
+}
+
+// Synthesize implements echo.Synthesizer.
+func (e *EspeakSynthesizer) Synthesize(ctx context.Context, text string) (io.ReadCloser, error) {
+	infof("saying '%s'", text)
+	args := []string{"--stdout", "-v", e.voice}
+	if isSSML(text) {
+		args = append(args, "-m")
+	}
+	cmd := exec.CommandContext(ctx, e.path, args...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdReader{out, cmd}, nil
+}
+
+// cmdReader reads the output of a command and waits for it when closed.
+type cmdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (r *cmdReader) Close() error {
+	// closing the pipe first stops a command that is still writing.
+	r.ReadCloser.Close()
+	return r.cmd.Wait()
+}
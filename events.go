@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/slaskis/cloud-echo/echo"
+)
+
+// The events of the --events-json stream.
+const (
+	eventConfigSent     = "config_sent"
+	eventInterim        = "interim"
+	eventFinal          = "final"
+	eventSynthesisStart = "synthesis_start"
+	eventAudioWritten   = "audio_written"
+	eventError          = "error"
+)
+
+// lifecycleEvent is an event without anything more to it.
+type lifecycleEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+}
+
+// resultEvent is an interim or final transcript, at the time of its
+// Timestamp.
+type resultEvent struct {
+	Event        string             `json:"event"`
+	Time         time.Time          `json:"time"`
+	Transcript   string             `json:"transcript"`
+	Confidence   float32            `json:"confidence"`
+	Language     string             `json:"language,omitempty"`
+	Channel      int                `json:"channel,omitempty"`
+	Alternatives []echo.Alternative `json:"alternatives,omitempty"`
+	Words        []echo.Word        `json:"words,omitempty"`
+}
+
+// synthesisEvent is the start of the synthesis of a transcript.
+type synthesisEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Text  string    `json:"text"`
+}
+
+// audioEvent is speech written to a file.
+type audioEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Path  string    `json:"path"`
+}
+
+// errorEvent is an error that was logged, or ended the echo.
+type errorEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// eventStream writes events as json, one per line. All methods are no-ops
+// on a nil *eventStream.
+type eventStream struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// events is set when --events-json is.
+var events *eventStream
+
+func newEventStream(w io.Writer) *eventStream {
+	return &eventStream{enc: json.NewEncoder(w)}
+}
+
+func (s *eventStream) emit(event interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enc.Encode(event)
+}
+
+func (s *eventStream) configSent() {
+	s.emit(lifecycleEvent{eventConfigSent, clock.Now()})
+}
+
+func (s *eventStream) result(res echo.Result) {
+	event := eventInterim
+	if res.IsFinal {
+		event = eventFinal
+	}
+	s.emit(resultEvent{
+		Event:        event,
+		Time:         res.Timestamp,
+		Transcript:   res.Transcript,
+		Confidence:   res.Confidence,
+		Language:     res.Language,
+		Channel:      res.Channel,
+		Alternatives: res.Alternatives,
+		Words:        res.Words,
+	})
+}
+
+func (s *eventStream) synthesisStart(text string) {
+	s.emit(synthesisEvent{eventSynthesisStart, clock.Now(), text})
+}
+
+func (s *eventStream) audioWritten(path string) {
+	s.emit(audioEvent{eventAudioWritten, clock.Now(), path})
+}
+
+func (s *eventStream) error(format string, v ...interface{}) {
+	if s == nil {
+		return
+	}
+	s.emit(errorEvent{eventError, clock.Now(), fmt.Sprintf(format, v...)})
+}
+
+// eventRecognizer emits an event for each result of a Recognizer.
+type eventRecognizer struct {
+	echo.Recognizer
+	results chan echo.Result
+}
+
+func newEventRecognizer(ctx context.Context, rec echo.Recognizer) *eventRecognizer {
+	r := &eventRecognizer{Recognizer: rec, results: make(chan echo.Result)}
+	go func() {
+		defer close(r.results)
+		for res := range rec.Results() {
+			events.result(res)
+			select {
+			case r.results <- res:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// Results implements echo.Recognizer.
+func (r *eventRecognizer) Results() <-chan echo.Result {
+	return r.results
+}
+
+// eventSynthesizer emits an event for the start of each synthesis.
+type eventSynthesizer struct {
+	echo.Synthesizer
+}
+
+// Synthesize implements echo.Synthesizer.
+func (s eventSynthesizer) Synthesize(ctx context.Context, text string) (io.ReadCloser, error) {
+	events.synthesisStart(text)
+	return s.Synthesizer.Synthesize(ctx, text)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/slaskis/cloud-echo/echo"
+	"github.com/slaskis/cloud-echo/echo/echotest"
+)
+
+func TestEvents(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	useClock(t, echotest.NewClock(now))
+	var buf bytes.Buffer
+	s := newEventStream(&buf)
+	s.configSent()
+	s.result(echo.Result{Transcript: "hel", Timestamp: now.Add(time.Second)})
+	s.result(echo.Result{Transcript: "hello", Confidence: 0.5, IsFinal: true, Timestamp: now.Add(2 * time.Second), Language: "sv-SE"})
+	s.synthesisStart("hello")
+	s.audioWritten("1.mp3")
+	s.error("broken %d", 1)
+
+	var got []map[string]interface{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var event map[string]interface{}
+		if err := dec.Decode(&event); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, event)
+	}
+	want := []map[string]interface{}{
+		{"event": "config_sent", "time": "2020-01-02T03:04:05Z"},
+		{"event": "interim", "time": "2020-01-02T03:04:06Z", "transcript": "hel", "confidence": 0.0},
+		{"event": "final", "time": "2020-01-02T03:04:07Z", "transcript": "hello", "confidence": 0.5, "language": "sv-SE"},
+		{"event": "synthesis_start", "time": "2020-01-02T03:04:05Z", "text": "hello"},
+		{"event": "audio_written", "time": "2020-01-02T03:04:05Z", "path": "1.mp3"},
+		{"event": "error", "time": "2020-01-02T03:04:05Z", "error": "broken 1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("emitted\n%v\nwant\n%v", got, want)
+	}
+}
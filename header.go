@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// audioHeader is what the header of an audio file says about its audio.
+type audioHeader struct {
+	format     string
+	codec      string
+	sampleRate int
+	channels   int
+}
+
+// readAudioHeader reads the header of a wav or flac file. It returns nil if
+// r is neither, or its header can't be parsed.
+func readAudioHeader(r io.Reader) *audioHeader {
+	buf := make([]byte, 64)
+	n, _ := io.ReadFull(r, buf)
+	buf = buf[:n]
+	switch {
+	case len(buf) >= 42 && bytes.HasPrefix(buf, []byte("fLaC")):
+		// the stream info block always comes first, after its 4 byte
+		// header. The sample rate is 20 bits, followed by 3 bits of
+		// channels - 1, after 10 bytes of block and frame sizes.
+		info := buf[8:]
+		return &audioHeader{
+			format:     "flac",
+			codec:      "flac",
+			sampleRate: int(info[10])<<12 | int(info[11])<<4 | int(info[12])>>4,
+			channels:   int(info[12]>>1&0x7) + 1,
+		}
+	case len(buf) >= 36 && bytes.HasPrefix(buf, []byte("RIFF")) && string(buf[8:16]) == "WAVEfmt ":
+		var codec string
+		switch binary.LittleEndian.Uint16(buf[20:]) {
+		case 1:
+			if binary.LittleEndian.Uint16(buf[34:]) == 16 {
+				codec = "linear16"
+			}
+		case 7:
+			codec = "mulaw"
+		}
+		return &audioHeader{
+			format:     "wav",
+			codec:      codec,
+			sampleRate: int(binary.LittleEndian.Uint32(buf[24:])),
+			channels:   int(binary.LittleEndian.Uint16(buf[22:])),
+		}
+	}
+	return nil
+}
+
+// checkInputHeader compares the header of the input file, if it has one,
+// with --codec, --sample-rate and --channels. Options that weren't set are
+// taken from the header, and those that disagree with it are an error.
+func checkInputHeader(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("Failed to open input: %v", err)
+	}
+	h := readAudioHeader(file)
+	file.Close()
+	if h == nil {
+		return nil
+	}
+	if h.codec == "" {
+		return fmt.Errorf("%s is a %s file of an encoding that can't be recognized, convert it to 16-bit pcm or mu-law", name, h.format)
+	}
+	checks := []struct {
+		flag, header string
+	}{
+		{"codec", h.codec},
+		{"sample-rate", strconv.Itoa(h.sampleRate)},
+	}
+	// flac is recognized as is, only raw samples are split into channels.
+	if h.codec != "flac" {
+		checks = append(checks, struct{ flag, header string }{"channels", strconv.Itoa(h.channels)})
+	}
+	for _, o := range checks {
+		if value := flag.Lookup(o.flag).Value.String(); isFlagSet(o.flag) {
+			if !strings.EqualFold(value, o.header) {
+				return fmt.Errorf("--%s is %s but %s is %s according to its %s header", o.flag, value, name, o.header, h.format)
+			}
+			continue
+		}
+		debugf("using --%s %s from the %s header of %s", o.flag, o.header, h.format, name)
+		if err := flag.Set(o.flag, o.header); err != nil {
+			return err
+		}
+	}
+	return nil
+}
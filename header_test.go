@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// flacHeader is the start of a flac file of 16-bit samples.
+func flacHeader(sampleRate, channels int) []byte {
+	h := make([]byte, 42)
+	copy(h, "fLaC")
+	info := h[8:]
+	info[10] = byte(sampleRate >> 12)
+	info[11] = byte(sampleRate >> 4)
+	info[12] = byte(sampleRate<<4) | byte(channels-1)<<1
+	info[13] = 15 << 4
+	return h
+}
+
+// wavFormat is the header of a wav file with the format code and bits per
+// sample changed.
+func wavFormat(format, bits uint16) []byte {
+	h := wavHeader(8000, 1, 0)
+	binary.LittleEndian.PutUint16(h[20:], format)
+	binary.LittleEndian.PutUint16(h[34:], bits)
+	return h
+}
+
+func TestReadAudioHeader(t *testing.T) {
+	cases := []struct {
+		name   string
+		header []byte
+		want   *audioHeader
+	}{
+		{"wav", wavHeader(16000, 2, 100), &audioHeader{"wav", "linear16", 16000, 2}},
+		{"mulaw wav", wavFormat(7, 8), &audioHeader{"wav", "mulaw", 8000, 1}},
+		{"8-bit wav", wavFormat(1, 8), &audioHeader{"wav", "", 8000, 1}},
+		{"float wav", wavFormat(3, 32), &audioHeader{"wav", "", 8000, 1}},
+		{"flac", flacHeader(44100, 2), &audioHeader{"flac", "flac", 44100, 2}},
+		{"mono flac", flacHeader(16000, 1), &audioHeader{"flac", "flac", 16000, 1}},
+		{"short wav", wavHeader(16000, 1, 0)[:30], nil},
+		{"short flac", flacHeader(16000, 1)[:20], nil},
+		{"raw", make([]byte, 64), nil},
+		{"mp3", []byte("ID3\x04\x00\x00\x00\x00\x00\x00"), nil},
+		{"empty", nil, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := readAudioHeader(bytes.NewReader(c.header))
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("readAudioHeader() = %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
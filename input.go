@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// urlRetries is how many times in a row to try to reconnect to an input
+// url before giving up.
+const urlRetries = 5
+
+// urlReader reads audio from an http stream, reconnecting when the
+// connection fails until ctx is cancelled.
+type urlReader struct {
+	ctx  context.Context
+	url  string
+	body io.ReadCloser
+}
+
+func newURLReader(ctx context.Context, url string) (*urlReader, error) {
+	r := &urlReader{ctx: ctx, url: url}
+	if err := r.connect(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// connect opens the stream, retrying server errors and failed connections.
+func (r *urlReader) connect() error {
+	delay := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		body, err := r.get()
+		if err == nil {
+			r.body = body
+			return nil
+		}
+		if attempt >= urlRetries || r.ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+		warnf("Could not connect to %s, retrying in %s: %v", r.url, delay, err)
+		select {
+		case <-clock.After(delay):
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+func (r *urlReader) get() (io.ReadCloser, error) {
+	resp, err := ctxhttp.Get(r.ctx, nil, r.url)
+	if err != nil {
+		return nil, temporaryError{err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err := fmt.Errorf("unexpected status %s", resp.Status)
+		if resp.StatusCode >= 500 {
+			return nil, temporaryError{err}
+		}
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (r *urlReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if err == nil || err == io.EOF || r.ctx.Err() != nil {
+		return n, err
+	}
+	warnf("Lost the connection to %s: %v", r.url, err)
+	r.body.Close()
+	if err := r.connect(); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+func (r *urlReader) Close() error {
+	return r.body.Close()
+}
+
+// temporaryError marks an error as worth retrying.
+type temporaryError struct {
+	error
+}
+
+func (temporaryError) Temporary() bool { return true }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// pauseReader drops what's read from r while it's paused, so that the
+// recording keeps going but none of it is recognized. As the audio is
+// dropped it may only be used with a raw codec.
+type pauseReader struct {
+	r      io.Reader
+	paused int32
+}
+
+func (r *pauseReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.r.Read(p)
+		if err != nil || atomic.LoadInt32(&r.paused) == 0 {
+			return n, err
+		}
+	}
+}
+
+// toggle pauses or resumes r, and reports whether it's now paused.
+func (r *pauseReader) toggle() bool {
+	if atomic.CompareAndSwapInt32(&r.paused, 0, 1) {
+		return true
+	}
+	atomic.StoreInt32(&r.paused, 0)
+	return false
+}
+
+// rawTerminal turns off line buffering and echo of the terminal on stdin,
+// so that each key is read as it's pressed. The returned func restores the
+// terminal, and can be called more than once.
+func rawTerminal() (func(), error) {
+	state, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("-icanon", "-echo", "min", "1"); err != nil {
+		return nil, err
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if _, err := stty(strings.TrimSpace(state)); err != nil {
+				warnf("Could not restore the terminal: %v", err)
+			}
+		})
+	}, nil
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+// readKeys calls stop on 'Enter' and pauses or resumes r on 'Space', or any
+// key while it's paused. It returns once stop has been called.
+func readKeys(keys *bufio.Reader, r *pauseReader, stop func()) {
+	for {
+		key, err := keys.ReadByte()
+		if err != nil {
+			return
+		}
+		switch {
+		case key == '\n' || key == '\r':
+			stop()
+			return
+		case key == ' ' || atomic.LoadInt32(&r.paused) == 1:
+			if r.toggle() {
+				infof("paused, press any key to resume")
+			} else {
+				infof("resumed")
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"testing"
+)
+
+// chunkReader reads one chunk at a time, and calls after once each has
+// been read.
+type chunkReader struct {
+	chunks []string
+	after  func(i int)
+	i      int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.i == len(r.chunks) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[r.i])
+	r.after(r.i)
+	r.i++
+	return n, nil
+}
+
+func TestPauseReader(t *testing.T) {
+	r := &pauseReader{}
+	r.r = &chunkReader{
+		chunks: []string{"a", "b", "c", "d", "e"},
+		after: func(i int) {
+			// paused while "a" is read, and resumed while "c" is.
+			if i == 0 || i == 2 {
+				r.toggle()
+			}
+		},
+	}
+	var got string
+	p := make([]byte, 8)
+	for {
+		n, err := r.Read(p)
+		got += string(p[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got != "cde" {
+		t.Errorf("read %q, want %q", got, "cde")
+	}
+}
+
+func TestPauseReaderToggle(t *testing.T) {
+	r := &pauseReader{}
+	for _, want := range []bool{true, false, true} {
+		if got := r.toggle(); got != want {
+			t.Fatalf("toggle = %v, want %v", got, want)
+		}
+	}
+}
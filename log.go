@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+// level is the lowest level that is logged.
+var level = levelInfo
+
+// setLogLevel sets the level from its name.
+func setLogLevel(name string) error {
+	l, ok := levelNames[name]
+	if !ok {
+		return fmt.Errorf("Invalid log level: %s", name)
+	}
+	level = l
+	return nil
+}
+
+func logf(l logLevel, format string, v ...interface{}) {
+	if l >= level {
+		log.Printf(format, v...)
+	}
+}
+
+func debugf(format string, v ...interface{}) { logf(levelDebug, format, v...) }
+func infof(format string, v ...interface{})  { logf(levelInfo, format, v...) }
+func warnf(format string, v ...interface{})  { logf(levelWarn, format, v...) }
+func errorf(format string, v ...interface{}) {
+	logf(levelError, format, v...)
+	events.error(format, v...)
+}
+
+// logger logs the pipeline of an echo.Echo at the configured level.
+type logger struct{}
+
+func (logger) Debugf(format string, v ...interface{}) { debugf(format, v...) }
+func (logger) Infof(format string, v ...interface{})  { infof(format, v...) }
+func (logger) Warnf(format string, v ...interface{})  { warnf(format, v...) }
+func (logger) Errorf(format string, v ...interface{}) { errorf(format, v...) }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/slaskis/cloud-echo/echo"
+)
+
+// loopbackGuard keeps track of when the echo is being played, so that the
+// microphone doesn't pick it up and echo it again.
+type loopbackGuard struct {
+	cooldown time.Duration
+
+	mu      sync.Mutex
+	playing bool
+	until   time.Time
+}
+
+func newLoopbackGuard(cooldown time.Duration) *loopbackGuard {
+	return &loopbackGuard{cooldown: cooldown}
+}
+
+// start marks the start of a playback. It's a no-op on a nil guard.
+func (g *loopbackGuard) start() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	g.playing = true
+	g.mu.Unlock()
+}
+
+// end marks the end of a playback, which is guarded for another cooldown.
+func (g *loopbackGuard) end() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	g.playing = false
+	g.until = clock.Now().Add(g.cooldown)
+	g.mu.Unlock()
+}
+
+// muted reports whether input at now may have picked up the playback.
+func (g *loopbackGuard) muted(now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.playing || now.Before(g.until)
+}
+
+// mutedRecognizer drops the audio that's captured while the guard is muted.
+type mutedRecognizer struct {
+	echo.Recognizer
+	guard *loopbackGuard
+}
+
+// SendAudio implements echo.Recognizer.
+func (r mutedRecognizer) SendAudio(audio []byte) error {
+	if r.guard.muted(clock.Now()) {
+		return nil
+	}
+	return r.Recognizer.SendAudio(audio)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/slaskis/cloud-echo/echo"
+	"github.com/slaskis/cloud-echo/echo/echotest"
+)
+
+// useClock sets the clock for the rest of a test.
+func useClock(t *testing.T, c echo.Clock) {
+	old := clock
+	clock = c
+	t.Cleanup(func() { clock = old })
+}
+
+// sentRecognizer keeps the audio sent to it.
+type sentRecognizer struct {
+	echo.Recognizer
+	sent string
+}
+
+func (r *sentRecognizer) SendAudio(audio []byte) error {
+	r.sent += string(audio)
+	return nil
+}
+
+func TestLoopbackGuard(t *testing.T) {
+	c := echotest.NewClock(time.Unix(0, 0))
+	useClock(t, c)
+	guard := newLoopbackGuard(time.Second)
+	sent := &sentRecognizer{}
+	rec := mutedRecognizer{sent, guard}
+
+	steps := []struct {
+		name  string
+		step  func()
+		audio string
+		muted bool
+	}{
+		{"before playing", func() {}, "a", false},
+		{"playing", guard.start, "b", true},
+		{"still playing", func() { c.Advance(5 * time.Second) }, "c", true},
+		{"cooling down", guard.end, "d", true},
+		{"almost cooled down", func() { c.Advance(999 * time.Millisecond) }, "e", true},
+		{"cooled down", func() { c.Advance(time.Millisecond) }, "f", false},
+		{"later", func() { c.Advance(time.Minute) }, "g", false},
+	}
+	want := ""
+	for _, s := range steps {
+		s.step()
+		if got := guard.muted(c.Now()); got != s.muted {
+			t.Errorf("%s: muted = %v, want %v", s.name, got, s.muted)
+		}
+		rec.SendAudio([]byte(s.audio))
+		if !s.muted {
+			want += s.audio
+		}
+	}
+	if sent.sent != want {
+		t.Errorf("sent %q, want %q", sent.sent, want)
+	}
+}
+
+func TestNilLoopbackGuard(t *testing.T) {
+	var guard *loopbackGuard
+	// a playWriter without a guard marks its playbacks on a nil one.
+	guard.start()
+	guard.end()
+}
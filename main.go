@@ -2,230 +2,1401 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
+	"unicode"
 
-	speech "cloud.google.com/go/speech/apiv1beta1"
+	speech "cloud.google.com/go/speech/apiv1"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/polly"
-	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1beta1"
+	"github.com/slaskis/cloud-echo/echo"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
 )
 
 type options struct {
-	sampleRate int
-	language   string
-	codec      string
+	sampleRate    int
+	channels      int
+	language      string
+	detectLang    string
+	codec         string
+	voice         string
+	play          bool
+	input         string
+	resumeFrom    string
+	checkpoint    string
+	batch         string
+	stdin         bool
+	inputURL      string
+	saveInput     string
+	replay        string
+	replayDelay   time.Duration
+	noPrompt      bool
+	outDir        string
+	outS3         string
+	concatOutput  string
+	maxSession    time.Duration
+	recvTimeout   time.Duration
+	maxDuration   time.Duration
+	format        string
+	eventsJSON    bool
+	minConf       float64
+	dedupWindow   time.Duration
+	segmentGap    time.Duration
+	speechTimeout time.Duration
+	interim       bool
+	listVoices    bool
+	check         bool
+	sampleClip    string
+	sampleText    string
+	awsRegion     string
+	awsProfile    string
+	soxPath       string
+	captureArgs   string
+	soxEffects    string
+	logLevel      string
+	verbose       bool
+	quiet         bool
+	translateTo   string
+	ttsRate       int
+	ssml          bool
+	ssmlTmpl      string
+	echoPrefix    string
+	echoSuffix    string
+	rate          string
+	pitch         string
+	volume        string
+	outFormat     string
+	transcripts   string
+	ttsRetries    int
+	startRetries  int
+	ttsWorkers    int
+	queueSize     int
+	ttsTimeout    time.Duration
+	dryRun        bool
+	phrases       string
+	maxAlts       int
+	wordTimings   bool
+	phrasesFile   string
+	ttsBackend    string
+	lexicons      stringsFlag
+	sttBackend    string
+	azureKey      string
+	azureRegion   string
+	serve         string
+	serveLangs    stringsFlag
+	metrics       string
+	webhook       string
+	otelEndpoint  string
+	voiceCacheTTL time.Duration
+	refreshVoices bool
+	profanity     bool
+	single        bool
+	bargeIn       bool
+	loopback      time.Duration
+	normalize     bool
+	vad           bool
+	vadThreshold  float64
+	chunkSize     int
+	config        string
+	printConfig   bool
 }
 
 var opts = options{}
 
+// clock tells the time of the transcripts, the speech files and the summary.
+var clock echo.Clock = echo.SystemClock
+
 func init() {
-	flag.IntVar(&opts.sampleRate, "sample-rate", 16000, "sample rate of stream")
+	flag.StringVar(&opts.config, "config", "", "read options from a file of name: value or name = value lines, flags and CLOUD_ECHO_* environment variables take precedence")
+	flag.BoolVar(&opts.printConfig, "print-config", false, "print the effective options and exit")
+	flag.StringVar(&opts.logLevel, "log-level", "info", "log level, one of debug, info, warn or error")
+	flag.BoolVar(&opts.verbose, "verbose", false, "log everything, same as --log-level debug")
+	flag.BoolVar(&opts.quiet, "quiet", false, "only log errors, same as --log-level error")
+	flag.IntVar(&opts.sampleRate, "sample-rate", 16000, "sample rate of stream (defaults to 8000 for mulaw)")
+	flag.IntVar(&opts.ttsRate, "tts-sample-rate", 0, "sample rate of the synthesized audio (defaults to --sample-rate, or the closest rate below it that the tts backend supports)")
+	flag.IntVar(&opts.channels, "channels", 1, "channels of audio to recognize separately, more than 1 requires the linear16 codec")
 	flag.StringVar(&opts.language, "language", "sv-SE", "language to parse")
-	flag.StringVar(&opts.codec, "codec", "flac", "audio codec")
-	flag.Parse()
+	flag.StringVar(&opts.detectLang, "detect-language", "", "comma separated languages to detect which one is spoken from a few seconds of the input, falling back to --language")
+	flag.StringVar(&opts.codec, "codec", "flac", "audio codec, flac, linear16 (raw 16-bit samples) or mulaw")
+	flag.StringVar(&opts.translateTo, "translate-to", "", "translate transcripts to this language before echoing them, e.g. en-US")
+	flag.StringVar(&opts.ttsBackend, "tts-backend", "polly", "speech synthesizer, polly, azure or espeak (offline, requires espeak-ng)")
+	flag.StringVar(&opts.sttBackend, "stt-backend", "google", "speech recognizer, google or azure (requires the linear16 codec)")
+	flag.StringVar(&opts.azureKey, "azure-key", "", "key of the azure speech resource (defaults to $AZURE_SPEECH_KEY)")
+	flag.StringVar(&opts.azureRegion, "azure-region", "", "region of the azure speech resource, e.g. westeurope (defaults to $AZURE_SPEECH_REGION)")
+	flag.Var(&opts.lexicons, "lexicon", "name of a polly pronunciation lexicon to apply, may be repeated or comma separated")
+	flag.StringVar(&opts.voice, "voice", "", "voice id (defaults to the first polly or azure voice for the language)")
+	flag.StringVar(&opts.awsRegion, "aws-region", "", "aws region for polly (defaults to the environment)")
+	flag.StringVar(&opts.awsProfile, "aws-profile", "", "aws shared config profile for polly")
+	flag.StringVar(&opts.soxPath, "sox-path", "sox", "path to the sox binary used to capture audio")
+	flag.StringVar(&opts.soxEffects, "sox-effects", "", "sox effects to condition the recording with before it's recognized, e.g. 'highpass 100' to cut rumble, 'highpass 100 lowpass 8000' to keep the voice band or 'gain -n' to normalize")
+	flag.StringVar(&opts.captureArgs, "capture-args", "", "arguments for the capture command (defaults to recording the default device with --sample-rate and --codec)")
+	flag.StringVar(&opts.input, "input", "", "read audio from a file instead of the microphone")
+	flag.StringVar(&opts.replay, "replay", "", "synthesize the transcripts of a --transcript-file instead of recognizing speech")
+	flag.DurationVar(&opts.replayDelay, "replay-delay", 0, "how long to wait between the lines of --replay")
+	flag.StringVar(&opts.saveInput, "save-input", "", "also write the audio sent to the recognizer to this file")
+	flag.StringVar(&opts.inputURL, "input-url", "", "read audio from an http stream instead of the microphone")
+	flag.StringVar(&opts.resumeFrom, "resume-from", "", "resume --input from this offset in bytes, or the offset in this --checkpoint file")
+	flag.StringVar(&opts.checkpoint, "checkpoint", "", "write how far into --input the echo has come to this file, to resume from with --resume-from")
+	flag.StringVar(&opts.batch, "batch", "", "echo each audio file in this directory, or matching this glob, into a directory of its own in the output directory")
+	flag.BoolVar(&opts.stdin, "stdin", false, "read audio from stdin instead of the microphone")
+	flag.BoolVar(&opts.noPrompt, "no-prompt", false, "don't stop or pause recording on a key, only stop on interrupt (the default when stdin isn't a terminal)")
+	flag.IntVar(&opts.chunkSize, "chunk-size", 1024, "bytes of audio to send to the recognizer at a time, larger chunks mean fewer requests but more latency")
+	flag.DurationVar(&opts.maxDuration, "max-duration", 0, "stop listening after this long, 0 listens until stopped")
+	flag.DurationVar(&opts.recvTimeout, "recv-timeout", 0, "reconnect when the recognizer hasn't responded in this long, 0 waits forever")
+	flag.DurationVar(&opts.maxSession, "max-session", 0, "start a new recognition session after this long (0 waits for the API to end it)")
+	flag.StringVar(&opts.outFormat, "output-format", "mp3", "format of the synthesized audio, mp3, ogg_vorbis, pcm (raw 16-bit mono samples, the default for mulaw) or wav (pcm with a header)")
+	flag.StringVar(&opts.webhook, "webhook", "", "post each final transcript as json to this url")
+	flag.StringVar(&opts.transcripts, "transcript-file", "", "append the final transcripts of the session to this file")
+	flag.StringVar(&opts.outDir, "out-dir", "./tmp", "directory to write the synthesized audio to")
+	flag.StringVar(&opts.outS3, "out-s3", "", "upload the synthesized audio to this s3 url, like s3://bucket/prefix, instead of --out-dir")
+	flag.BoolVar(&opts.eventsJSON, "events-json", false, "write the events of the session as json on stdout, one object per line")
+	flag.StringVar(&opts.format, "format", "text", "transcript output format, text or json (one object per final transcript on stdout)")
+	flag.Float64Var(&opts.minConf, "min-confidence", 0, "skip final transcripts with a lower confidence (0-1)")
+	flag.StringVar(&opts.phrases, "phrases", "", "comma separated words and phrases to help recognition along, each optionally weighted as phrase:boost")
+	flag.IntVar(&opts.maxAlts, "max-alternatives", 0, "how many alternatives google may recognize for each transcript, up to 30, all of which are in the json output while the best is echoed")
+	flag.BoolVar(&opts.wordTimings, "word-timings", false, "include the words of each final transcript with when they were spoken in the json output, only for the google stt backend")
+	flag.StringVar(&opts.phrasesFile, "phrases-file", "", "file with words and phrases to help recognition along, one per line")
+	flag.DurationVar(&opts.speechTimeout, "speech-timeout", 0, "end an utterance after this long without new speech, e.g. 800ms, 0 lets the recognizer decide")
+	flag.DurationVar(&opts.segmentGap, "segment-gap", 0, "join final transcripts less than this far apart into one utterance, e.g. 1.5s, 0 echoes each of them")
+	flag.DurationVar(&opts.dedupWindow, "dedup-window", 5*time.Second, "skip a final transcript that repeats the previous one within this long, 0 keeps repeats")
+	flag.BoolVar(&opts.normalize, "normalize", false, "normalize the loudness of each utterance with sox, which delays it until it's been synthesized completely")
+	flag.DurationVar(&opts.loopback, "loopback-cooldown", 0, "ignore the input while the echo plays and for this long after, so that it isn't picked up and echoed again, requires --play and the linear16 or mulaw codec")
+	flag.BoolVar(&opts.bargeIn, "barge-in", false, "stop playing the echo when new speech is recognized, requires --play")
+	flag.BoolVar(&opts.single, "single", false, "stop after echoing the first utterance")
+	flag.BoolVar(&opts.vad, "vad", false, "only send audio with speech to the recognizer, requires the linear16 codec")
+	flag.Float64Var(&opts.vadThreshold, "vad-threshold", 0.02, "level of audio, as a fraction of full scale, that --vad considers speech")
+	flag.BoolVar(&opts.profanity, "profanity-filter", false, "mask profanities in the transcripts")
+	flag.BoolVar(&opts.interim, "interim", false, "also echo interim transcripts, not just final ones")
+	flag.BoolVar(&opts.ssml, "ssml", false, "synthesize transcripts as ssml, escaped in a <speak> document unless --ssml-template is set")
+	flag.IntVar(&opts.ttsWorkers, "tts-concurrency", 1, "how many transcripts to synthesize at the same time, the audio is still output in order")
+	flag.IntVar(&opts.queueSize, "queue-size", 0, "how many transcripts may wait to be synthesized before the oldest is dropped, 0 waits for the synthesis instead")
+	flag.DurationVar(&opts.ttsTimeout, "tts-timeout", 30*time.Second, "how long to wait for the audio of a synthesis to start before it's skipped, 0 waits forever")
+	flag.IntVar(&opts.startRetries, "startup-retries", 3, "how many times to retry connecting to the recognizer when starting, on temporary errors")
+	flag.IntVar(&opts.ttsRetries, "tts-retries", 3, "how many times to retry a synthesis that failed with a temporary error")
+	flag.StringVar(&opts.echoPrefix, "echo-prefix", "", "text to say before each transcript, e.g. 'You said: '")
+	flag.StringVar(&opts.echoSuffix, "echo-suffix", "", "text to say after each transcript")
+	flag.StringVar(&opts.rate, "rate", "", "speaking rate of the synthesized speech, e.g. slow or 80%")
+	flag.StringVar(&opts.pitch, "pitch", "", "pitch of the synthesized speech, e.g. high or -10%")
+	flag.StringVar(&opts.volume, "volume", "", "volume of the synthesized speech, e.g. loud or +3dB")
+	flag.StringVar(&opts.ssmlTmpl, "ssml-template", "", "wrap transcripts in ssml, with {{.}} replaced by the escaped transcript, e.g. '<speak><prosody rate=\"slow\">{{.}}</prosody></speak>'")
+	flag.StringVar(&opts.serve, "serve", "", "instead of listening, serve POST /echo and a /ws websocket on this address, e.g. :8080")
+	flag.Var(&opts.serveLangs, "serve-languages", "languages besides --language that clients of --serve may ask for, may be repeated or comma separated")
+	flag.StringVar(&opts.otelEndpoint, "otel-endpoint", "", "send traces of the pipeline to this OpenTelemetry collector, e.g. http://localhost:4318")
+	flag.StringVar(&opts.metrics, "metrics", "", "serve prometheus metrics on /metrics on this address, e.g. :9090")
+	flag.BoolVar(&opts.dryRun, "dry-run", false, "recognize speech but don't synthesize or write any audio")
+	flag.DurationVar(&opts.voiceCacheTTL, "voice-cache-ttl", 24*time.Hour, "how long to cache the polly voices on disk, 0 disables the cache")
+	flag.BoolVar(&opts.refreshVoices, "refresh-voices", false, "refresh the cached polly voices")
+	flag.BoolVar(&opts.check, "check", false, "check that the speech services can be reached and exit, without capturing any audio")
+	flag.BoolVar(&opts.listVoices, "list-voices", false, "list the polly voices for the language and exit")
+	flag.StringVar(&opts.sampleClip, "sample-clip", "", "write the speech of --sample-text to this file and exit, to audition a voice")
+	flag.StringVar(&opts.sampleText, "sample-text", "Hello! This is how I sound.", "text to say with --sample-clip")
+	flag.StringVar(&opts.concatOutput, "concat-output", "", "write the speech of the whole session to this file, instead of a file per utterance to the output directory")
+	flag.BoolVar(&opts.play, "play", false, "play the synthesized audio instead of writing it to the output directory")
 }
 
+// exit codes, 2 is used by the flag package for invalid flags.
+const (
+	exitError      = 1
+	exitAuth       = 3
+	exitCapture    = 4
+	exitRecognize  = 5
+	exitSynthesize = 6
+	exitOutput     = 7
+)
+
 // build and run with:
 //
-//   sox -d  -r 16k -c 1 -t flac - | ./main
+//   sox -d  -r 16k -c 1 -t flac - | ./main --stdin
 //
 func main() {
-	var wg sync.WaitGroup
-	ctx := context.Background()
-	svc := polly.New(session.New())
+	flag.Parse()
+	if err := loadEnv(flag.CommandLine, os.Environ()); err != nil {
+		log.Fatalf("Failed to load environment: %v", err)
+	}
+	if opts.config != "" {
+		if err := loadConfig(flag.CommandLine, opts.config); err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+	}
 
-	resp, err := svc.DescribeVoices(&polly.DescribeVoicesInput{
-		LanguageCode: aws.String(opts.language),
-	})
-	if err != nil {
-		log.Fatalf("Failed to get voices: %v", err)
+	if err := run(); err != nil {
+		events.error("%v", err)
+		log.Print(err)
+		os.Exit(exitCode(err))
 	}
-	voice := *resp.Voices[0].Id
+}
 
-	// Creates a client.
-	client, err := speech.NewClient(ctx)
-	if err != nil {
-		log.Fatalf("Failed to create client: %v", err)
+// exitCode returns the exit code for err.
+func exitCode(err error) int {
+	var (
+		auth       authError
+		capture    echo.CaptureError
+		recognize  echo.RecognizeError
+		synthesize echo.SynthesizeError
+		output     echo.OutputError
+	)
+	switch {
+	case errors.As(err, &auth):
+		return exitAuth
+	case errors.As(err, &capture):
+		return exitCapture
+	case errors.As(err, &recognize):
+		return exitRecognize
+	case errors.As(err, &synthesize):
+		return exitSynthesize
+	case errors.As(err, &output):
+		return exitOutput
 	}
+	return exitError
+}
 
-	stream, err := client.StreamingRecognize(ctx)
-	if err != nil {
-		log.Fatal(err)
+// run sets up the pipeline from the options and runs it until the input
+// ends.
+func run() error {
+	if opts.printConfig {
+		if err := printConfig(os.Stdout, flag.CommandLine); err != nil {
+			return err
+		}
+		return nil
 	}
 
-	codec, ok := speechpb.RecognitionConfig_AudioEncoding_value[strings.ToUpper(opts.codec)]
-	if !ok {
-		log.Fatalf("Invalid codec: %s", opts.codec)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	switch {
+	case opts.verbose:
+		opts.logLevel = "debug"
+	case opts.quiet:
+		opts.logLevel = "error"
+	}
+	if err := setLogLevel(opts.logLevel); err != nil {
+		return err
 	}
+	var config bytes.Buffer
+	if err := printConfig(&config, flag.CommandLine); err != nil {
+		return err
+	}
+	debugf("options:\n%s", config.String())
 
-	// send the initial configuration message.
-	err = stream.Send(&speechpb.StreamingRecognizeRequest{
-		StreamingRequest: &speechpb.StreamingRecognizeRequest_StreamingConfig{
-			StreamingConfig: &speechpb.StreamingRecognitionConfig{
-				Config: &speechpb.RecognitionConfig{
-					LanguageCode: opts.language,
-					Encoding:     speechpb.RecognitionConfig_AudioEncoding(codec),
-					SampleRate:   int32(opts.sampleRate),
-				},
-			},
-		},
-	})
+	if opts.soxEffects != "" && opts.captureArgs != "" {
+		return fmt.Errorf("--sox-effects can't be combined with --capture-args, add the effects to its arguments instead")
+	}
+	if opts.wordTimings && opts.sttBackend != "google" {
+		return fmt.Errorf("--word-timings only supports the google stt backend")
+	}
+	if opts.maxAlts < 0 || opts.maxAlts > 30 {
+		return fmt.Errorf("--max-alternatives must be between 0 and 30")
+	}
+	if opts.format != "text" && opts.format != "json" {
+		return fmt.Errorf("Invalid format: %s", opts.format)
+	}
+	if opts.eventsJSON {
+		if opts.format == "json" {
+			return fmt.Errorf("--events-json already writes the transcripts, it can't be combined with --format json")
+		}
+		events = newEventStream(os.Stdout)
+	}
+	if opts.chunkSize <= 0 {
+		return fmt.Errorf("Invalid chunk size: %d", opts.chunkSize)
+	}
+	if opts.channels < 1 {
+		return fmt.Errorf("Invalid channels: %d", opts.channels)
+	}
+	if opts.ttsWorkers < 1 {
+		return fmt.Errorf("Invalid tts concurrency: %d", opts.ttsWorkers)
+	}
+	if opts.bargeIn && !opts.play {
+		return fmt.Errorf("--barge-in requires --play")
+	}
+	if opts.concatOutput != "" && opts.play {
+		return fmt.Errorf("--concat-output can't be combined with --play")
+	}
+	if opts.loopback > 0 && !opts.play {
+		return fmt.Errorf("--loopback-cooldown requires --play")
+	}
+	if opts.loopback > 0 && opts.bargeIn {
+		return fmt.Errorf("--loopback-cooldown can't be combined with --barge-in, which needs to hear the speech during playback")
+	}
+	if opts.queueSize < 0 {
+		return fmt.Errorf("Invalid queue size: %d", opts.queueSize)
+	}
+	inputs := 0
+	for _, set := range []bool{opts.stdin, opts.input != "", opts.inputURL != "", opts.replay != "", opts.batch != ""} {
+		if set {
+			inputs++
+		}
+	}
+	if inputs > 1 {
+		return fmt.Errorf("Only one of --stdin, --input, --input-url, --replay and --batch can be used")
+	}
+	if opts.detectLang != "" {
+		switch {
+		case opts.sttBackend != "google":
+			return fmt.Errorf("--detect-language only supports the google stt backend")
+		case opts.stdin || opts.inputURL != "" || opts.replay != "" || opts.batch != "":
+			return fmt.Errorf("--detect-language needs the microphone or --input to take a sample from")
+		case opts.channels > 1:
+			return fmt.Errorf("--detect-language can't detect the language of more than one channel")
+		case opts.input != "" && opts.codec == "flac":
+			return fmt.Errorf("--detect-language can't take a sample of a flac --input")
+		}
+	}
+	if (opts.resumeFrom != "" || opts.checkpoint != "") && opts.input == "" {
+		return fmt.Errorf("--resume-from and --checkpoint require --input, as only a file can be resumed")
+	}
+	if opts.outS3 != "" && (opts.play || opts.concatOutput != "" || opts.batch != "") {
+		return fmt.Errorf("--out-s3 can't be combined with --play, --concat-output or --batch")
+	}
+	if opts.batch != "" && (opts.play || opts.concatOutput != "") {
+		return fmt.Errorf("--batch writes a directory of speech per file, it can't be combined with --play or --concat-output")
+	}
+
+	if opts.input != "" {
+		if err := checkInputHeader(opts.input); err != nil {
+			return err
+		}
+	}
+	if opts.batch != "" {
+		// the files of a batch must all agree with the first one.
+		names, err := batchFiles(opts.batch)
+		if err != nil {
+			return err
+		}
+		if err := checkInputHeader(names[0]); err != nil {
+			return err
+		}
+	}
+	codec, err := lookupCodec(opts.codec)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	var offset int64
+	if opts.resumeFrom != "" {
+		if codec.sampleSize == 0 {
+			return fmt.Errorf("--resume-from can't be used with %s, which can't be recognized from the middle", opts.codec)
+		}
+		offset, err = resumeOffset(opts.resumeFrom)
+		if err != nil {
+			return err
+		}
+		// resume at the start of a frame of samples.
+		offset -= offset % int64(codec.sampleSize*opts.channels)
+	}
+	encoding := codec.encoding
+	if !isFlagSet("sample-rate") {
+		opts.sampleRate = codec.sampleRate
+	}
+	if !isFlagSet("output-format") {
+		opts.outFormat = codec.outFormat
+	}
+	if encoding == speechpb.RecognitionConfig_MULAW && opts.sampleRate != 8000 {
+		warnf("mulaw is usually sampled at 8000 hertz, not %d", opts.sampleRate)
+	}
+	if opts.vad && encoding != speechpb.RecognitionConfig_LINEAR16 {
+		return fmt.Errorf("--vad requires the linear16 codec, not %s", opts.codec)
+	}
+	if opts.loopback > 0 && codec.sampleSize == 0 {
+		// dropping the audio of a compressed stream would corrupt it.
+		return fmt.Errorf("--loopback-cooldown requires the linear16 or mulaw codec, not %s", opts.codec)
+	}
+	if opts.channels > 1 && encoding != speechpb.RecognitionConfig_LINEAR16 {
+		return fmt.Errorf("--channels requires the linear16 codec, not %s", opts.codec)
+	}
+	if err := validateSampleRate(encoding, opts.sampleRate); err != nil {
+		return err
+	}
+	if opts.ttsRate == 0 {
+		// the input may be sampled at a rate the tts backend can't output.
+		opts.ttsRate = ttsSampleRate(opts.ttsBackend, opts.outFormat, opts.sampleRate)
+		if opts.ttsRate != opts.sampleRate {
+			infof("synthesizing %s at %d hertz, as %s can't at %d", opts.outFormat, opts.ttsRate, opts.ttsBackend, opts.sampleRate)
+		}
+	}
+	switch opts.sttBackend {
+	case "google":
+	case "azure":
+		if encoding != speechpb.RecognitionConfig_LINEAR16 {
+			return fmt.Errorf("--stt-backend azure requires the linear16 codec, not %s", opts.codec)
+		}
+		if opts.serve != "" {
+			return fmt.Errorf("--serve only supports the google stt backend")
+		}
+	default:
+		return fmt.Errorf("Invalid stt backend: %s", opts.sttBackend)
+	}
+	switch opts.ttsBackend {
+	case "polly":
+		if _, err := pollySampleRate(opts.outFormat, opts.ttsRate); err != nil {
+			return err
+		}
+	case "azure":
+		if _, err := azureOutputFormat(opts.outFormat, opts.ttsRate); err != nil {
+			return err
+		}
+		if opts.listVoices {
+			return fmt.Errorf("--list-voices only supports the polly tts backend")
+		}
+	case "espeak":
+		infof("espeak only writes wav, ignoring --output-format")
+		opts.outFormat = "wav"
+	default:
+		return fmt.Errorf("Invalid tts backend: %s", opts.ttsBackend)
 	}
 
-	log.Printf("sent config. now listening on stdin")
+	if opts.sttBackend == "azure" || opts.ttsBackend == "azure" {
+		if opts.azureKey == "" {
+			opts.azureKey = os.Getenv("AZURE_SPEECH_KEY")
+		}
+		if opts.azureRegion == "" {
+			opts.azureRegion = os.Getenv("AZURE_SPEECH_REGION")
+		}
+		if opts.azureKey == "" || opts.azureRegion == "" {
+			return authError{fmt.Errorf("No Azure credentials found, set --azure-key and --azure-region or AZURE_SPEECH_KEY and AZURE_SPEECH_REGION")}
+		}
+	}
 
-	texts := make(chan string)
-	streams := make(chan io.ReadCloser)
+	googleSTT := opts.replay == "" && opts.sttBackend == "google"
+	if !opts.listVoices && !opts.check && opts.sampleClip == "" && (googleSTT || opts.translateTo != "") {
+		if err := checkGoogleCredentials(ctx); err != nil {
+			return err
+		}
+	}
 
-	cmd := exec.CommandContext(ctx, "sh", "-c", "/usr/local/bin/sox -d -r "+strconv.Itoa(opts.sampleRate)+" -c 1 -t "+opts.codec+" -")
-	cmd.Stderr = os.Stderr
-	out, err := cmd.StdoutPipe()
+	stats = newMetrics()
+	if opts.metrics != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", stats)
+		l, err := net.Listen("tcp", opts.metrics)
+		if err != nil {
+			return fmt.Errorf("Failed to serve metrics: %v", err)
+		}
+		go func() {
+			errorf("Metrics server failed: %v", http.Serve(l, mux))
+		}()
+	}
+
+	if opts.otelEndpoint != "" {
+		traces = newTracer(opts.otelEndpoint)
+		defer traces.Close()
+	}
+
+	if opts.detectLang != "" && !opts.check {
+		language, err := detectLanguage(ctx, codec, encoding, detectLanguages(opts.detectLang))
+		if err != nil {
+			return err
+		}
+		if language == "" {
+			warnf("Could not detect the language, using %s", opts.language)
+		} else {
+			infof("detected %s", language)
+			opts.language = language
+		}
+	}
+
+	// the echo speaks the language it translates to.
+	voiceLanguage := opts.language
+	if opts.translateTo != "" {
+		voiceLanguage = opts.translateTo
+	}
+
+	if opts.check {
+		return runCheck(ctx, os.Stdout, encoding, voiceLanguage)
+	}
+
+	if opts.listVoices {
+		sess, err := newSession()
+		if err != nil {
+			return fmt.Errorf("Failed to create aws session: %w", err)
+		}
+		if err := listVoices(os.Stdout, polly.New(sess), voiceLanguage); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	synth, err := newSynthesizer(voiceLanguage)
 	if err != nil {
-		log.Fatal(err)
+		return echo.SynthesizeError{Err: err}
 	}
-	defer out.Close()
+	synths := newSynthesizers(voiceLanguage, synth)
 
-	err = cmd.Start()
+	if opts.rate != "" || opts.pitch != "" || opts.volume != "" {
+		if opts.ssmlTmpl != "" {
+			return fmt.Errorf("--ssml-template can't be combined with --rate, --pitch or --volume")
+		}
+		opts.ssmlTmpl, err = prosodyTemplate(opts.rate, opts.pitch, opts.volume)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.ssml && opts.ssmlTmpl == "" {
+		// the transcripts are plain text, which may not be valid ssml.
+		opts.ssmlTmpl = plainSSMLTemplate
+	}
+	var ssml *ssmlTemplate
+	if opts.ssmlTmpl != "" {
+		ssml, err = parseSSMLTemplate(opts.ssmlTmpl)
+		if err != nil {
+			return fmt.Errorf("Invalid ssml template: %v", err)
+		}
+	}
+
+	if opts.sampleClip != "" {
+		return writeSample(ctx, synth, ssml)
+	}
+
+	var transcripts *os.File
+	if opts.transcripts != "" {
+		transcripts, err = os.OpenFile(opts.transcripts, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to open transcript file: %v", err)
+		}
+		defer transcripts.Close()
+	}
+
+	var translator echo.Translator
+	if opts.translateTo != "" {
+		translator, err = NewGoogleTranslator(ctx, opts.language, opts.translateTo)
+		if err != nil {
+			return fmt.Errorf("Failed to create translator: %v", err)
+		}
+		translator = meteredTranslator{translator}
+	}
+
+	if !opts.play && !opts.dryRun && opts.concatOutput == "" && opts.outS3 == "" {
+		if err := os.MkdirAll(opts.outDir, 0755); err != nil {
+			return echo.OutputError{Err: fmt.Errorf("Failed to create output directory %s: %w", opts.outDir, err)}
+		}
+	}
+
+	phrases, err := loadPhrases()
 	if err != nil {
-		log.Fatalf("start: %v", err)
+		return fmt.Errorf("Failed to read phrases: %v", err)
 	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		fmt.Print("Press 'Enter' to stop")
-		bufio.NewReader(os.Stdin).ReadBytes('\n')
-		err := cmd.Process.Signal(os.Interrupt)
+	// Creates a client.
+	var client *speech.Client
+	if googleSTT {
+		err = retryStartup(ctx, "create speech client", opts.startRetries, func() (err error) {
+			client, err = speech.NewClient(ctx)
+			return err
+		})
 		if err != nil {
-			log.Fatal(err)
+			return echo.RecognizeError{Err: fmt.Errorf("Failed to create client: %w", err)}
 		}
-	}()
+	}
+
+	if opts.serve != "" {
+		srv := newServer(client, encoding, phrases, synths, translator, ssml)
+		infof("serving on %s", opts.serve)
+		return http.ListenAndServe(opts.serve, srv)
+	}
 
-	wg.Add(1)
+	// stop ends the input, letting the rest of the pipeline drain.
+	stopped := make(chan struct{})
+	var once sync.Once
+	stop := func() {
+		once.Do(func() { close(stopped) })
+	}
+
+	// the first signal stops the input, a second one aborts the pipeline.
+	sigc := make(chan os.Signal, 2)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		defer wg.Done()
-
-		// pipe stdin to the API
-		buf := make([]byte, 1024)
-		for {
-			n, err := out.Read(buf)
-			if err == io.EOF {
-				// Nothing else to pipe, close the stream.
-				if err := stream.CloseSend(); err != nil {
-					log.Fatalf("Could not close stream: %v", err)
+		<-sigc
+		infof("stopping, interrupt again to abort")
+		stop()
+		<-sigc
+		cancel()
+	}()
+
+	if opts.maxDuration > 0 {
+		timer := stopAfter(opts.maxDuration, stop)
+		defer timer.Stop()
+	}
+
+	var rec echo.Recognizer
+	var out io.ReadCloser
+	var progress *checkpoint
+	var guard *loopbackGuard
+	if opts.replay != "" {
+		file, err := os.Open(opts.replay)
+		if err != nil {
+			return fmt.Errorf("Failed to open replay: %v", err)
+		}
+		defer file.Close()
+		rec = newReplayRecognizer(ctx, file, opts.replayDelay, stopped)
+		out = ioutil.NopCloser(strings.NewReader(""))
+	} else if opts.batch == "" {
+		rec, err = newRecognizer(ctx, client, encoding, phrases)
+		if err != nil {
+			return echo.RecognizeError{Err: err}
+		}
+		infof("sent config. now listening on stdin")
+
+		if opts.stdin {
+			// there's no Enter to stop as stdin is the audio, close the pipe or
+			// interrupt instead.
+			out = stopReader{os.Stdin, stopped}
+		} else if opts.input != "" {
+			file, err := os.Open(opts.input)
+			if err != nil {
+				return echo.CaptureError{Err: fmt.Errorf("Failed to open input: %w", err)}
+			}
+			if offset > 0 {
+				infof("resuming %s from byte %d", opts.input, offset)
+				if _, err := file.Seek(offset, io.SeekStart); err != nil {
+					return echo.CaptureError{Err: fmt.Errorf("Failed to seek input: %w", err)}
 				}
-				log.Printf("sent all the audio")
-				return
 			}
+			if opts.checkpoint != "" {
+				progress = newCheckpoint(opts.checkpoint, offset)
+			}
+			out = stopReader{readCloser{progress.reader(file), file}, stopped}
+		} else if opts.inputURL != "" {
+			stream, err := newURLReader(ctx, opts.inputURL)
 			if err != nil {
-				log.Printf("Could not read from stdin: %v", err)
-				continue
+				return echo.CaptureError{Err: fmt.Errorf("Failed to open input url: %w", err)}
 			}
-			err = stream.Send(&speechpb.StreamingRecognizeRequest{
-				StreamingRequest: &speechpb.StreamingRecognizeRequest_AudioContent{
-					AudioContent: buf[:n],
-				},
-			})
+			out = stopReader{stream, stopped}
+		} else {
+			out, err = capture(ctx, codec, stop, stopped)
 			if err != nil {
-				log.Printf("Could not send audio: %v", err)
+				return echo.CaptureError{Err: err}
 			}
 		}
-	}()
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for {
-			resp, err := stream.Recv()
-			if err == io.EOF {
-				log.Printf("recv eof %v", resp)
-				close(texts)
-				break
-			}
+		if opts.saveInput != "" {
+			file, err := os.Create(opts.saveInput)
 			if err != nil {
-				log.Fatalf("Cannot stream results: %v", err)
+				return fmt.Errorf("Failed to create input file: %v", err)
 			}
-			if err := resp.Error; err != nil {
-				log.Fatalf("Could not recognize: %v", err)
+			defer file.Close()
+			out = readCloser{io.TeeReader(out, file), out}
+		}
+
+		if opts.loopback > 0 {
+			guard = newLoopbackGuard(opts.loopback)
+			rec = mutedRecognizer{rec, guard}
+		}
+	}
+
+	e := newEcho(rec, synth, synths, translator, ssml)
+	var files *fileWriter
+	switch {
+	case opts.dryRun:
+	case opts.play:
+		e.Writer = &playWriter{format: opts.outFormat, sampleRate: opts.ttsRate, guard: guard}
+	case opts.concatOutput != "":
+		w, err := newConcatWriter(opts.concatOutput, opts.outFormat)
+		if err != nil {
+			return err
+		}
+		defer w.file.Close()
+		e.Writer = w
+	case opts.outS3 != "":
+		sess, err := newSession()
+		if err != nil {
+			return fmt.Errorf("Failed to create aws session: %w", err)
+		}
+		w, err := newS3Writer(sess, opts.outS3, opts.outFormat)
+		if err != nil {
+			return err
+		}
+		e.Writer = w
+		if opts.channels > 1 {
+			e.WriterFor = func(channel int) echo.Writer {
+				return channelWriter{w, channel}
 			}
-			for _, result := range resp.Results {
-				log.Printf("Result: %s", result)
-				for _, alt := range result.Alternatives {
-					texts <- alt.Transcript
-				}
+		}
+	default:
+		files = &fileWriter{
+			dir:   opts.outDir,
+			ext:   formatExtensions[opts.outFormat],
+			start: clock.Now(),
+		}
+		e.Writer = files
+		if opts.channels > 1 {
+			e.WriterFor = func(channel int) echo.Writer {
+				return channelWriter{files, channel}
 			}
 		}
-	}()
+	}
+	if opts.normalize && e.Writer != nil {
+		path, err := exec.LookPath(opts.soxPath)
+		if err != nil {
+			warnf("Not normalizing, could not find %s: %v", opts.soxPath, err)
+		} else {
+			e.Writer = normalizeWriter{e.Writer, path, opts.outFormat, opts.ttsRate}
+		}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	var hook *webhook
+	if opts.webhook != "" {
+		hook = newWebhook(ctx, opts.webhook)
+		defer hook.Close()
+	}
+	var finals int
+	e.OnResult = func(res echo.Result) error {
+		if res.IsFinal {
+			finals++
+			progress.recognized(res)
+		}
+		if opts.format == "json" && res.IsFinal {
+			if err := enc.Encode(res); err != nil {
+				return fmt.Errorf("Could not write transcript: %v", err)
+			}
+		}
+		if transcripts != nil && res.IsFinal {
+			if err := writeTranscript(transcripts, res); err != nil {
+				return fmt.Errorf("Could not write transcript: %v", err)
+			}
+		}
+		if hook != nil && res.IsFinal {
+			if err := hook.Send(res); err != nil {
+				return fmt.Errorf("Could not send transcript: %v", err)
+			}
+		}
+		return nil
+	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		err := cmd.Wait()
+	if progress != nil {
+		e.OnWritten = progress.written
+	}
+	if e.Writer != nil {
+		e.Writer = meteredWriter{e.Writer}
+	}
+	if writerFor := e.WriterFor; writerFor != nil {
+		e.WriterFor = func(channel int) echo.Writer {
+			return meteredWriter{writerFor(channel)}
+		}
+	}
+
+	start := clock.Now()
+	if opts.batch != "" {
+		err = runBatch(ctx, e, files, stopped, func() (echo.Recognizer, error) {
+			return newRecognizer(ctx, client, encoding, phrases)
+		})
+	} else {
+		err = e.Run(ctx, out)
+		if err := progress.Close(err == nil); err != nil {
+			errorf("Could not write checkpoint: %v", err)
+		}
+		// stop the capture in case the echo ended before the input did.
+		stop()
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	infof("%s", stats.summary(clock.Now().Sub(start), finals, codec.sampleSize))
+	return err
+}
+
+// newEcho creates an echo with the options that apply to every echo, both
+// of the command line and of the server, without a Writer.
+func newEcho(rec echo.Recognizer, synth echo.Synthesizer, synths *synthesizers, translator echo.Translator, ssml *ssmlTemplate) *echo.Echo {
+	e := &echo.Echo{
+		Recognizer:     rec,
+		Synthesizer:    synth,
+		SynthesizerFor: synths.get,
+		Translator:     translator,
+		Logger:         logger{},
+		ChunkSize:      opts.chunkSize,
+		Interim:        opts.interim,
+		MinConfidence:  opts.minConf,
+		DedupWindow:    opts.dedupWindow,
+		SegmentGap:     opts.segmentGap,
+		SpeechTimeout:  opts.speechTimeout,
+		Single:         opts.single,
+		BargeIn:        opts.bargeIn,
+		Concurrency:    opts.ttsWorkers,
+		QueueSize:      opts.queueSize,
+		Clock:          clock,
+	}
+	if opts.echoPrefix != "" || opts.echoSuffix != "" || ssml != nil {
+		e.Wrap = func(text string) (string, error) {
+			text = opts.echoPrefix + text + opts.echoSuffix
+			if ssml == nil {
+				return text, nil
+			}
+			return ssml.Wrap(text)
+		}
+	}
+	if traces != nil {
+		e.Tracer = traces
+	}
+	return e
+}
+
+// streamingConfig builds the recognition config for language from the
+// options.
+func streamingConfig(language string, encoding speechpb.RecognitionConfig_AudioEncoding, phrases []string) *speechpb.StreamingRecognitionConfig {
+	config := &speechpb.RecognitionConfig{
+		LanguageCode:          language,
+		Encoding:              encoding,
+		SampleRateHertz:       int32(opts.sampleRate),
+		ProfanityFilter:       opts.profanity,
+		MaxAlternatives:       int32(opts.maxAlts),
+		EnableWordTimeOffsets: opts.wordTimings,
+	}
+	if len(phrases) > 0 {
+		config.SpeechContexts = []*speechpb.SpeechContext{{Phrases: phrases}}
+	}
+	return &speechpb.StreamingRecognitionConfig{
+		Config:          config,
+		InterimResults:  opts.interim || opts.bargeIn || opts.speechTimeout > 0,
+		SingleUtterance: opts.single,
+	}
+}
+
+// loadPhrases returns the phrase hints from --phrases and --phrases-file.
+func loadPhrases() ([]string, error) {
+	var lines []string
+	for _, p := range strings.Split(opts.phrases, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			lines = append(lines, p)
+		}
+	}
+	if opts.phrasesFile != "" {
+		file, err := os.Open(opts.phrasesFile)
 		if err != nil {
-			log.Fatalf("wait: %v", err)
+			return nil, err
 		}
-	}()
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if p := strings.TrimSpace(scanner.Text()); p != "" {
+				lines = append(lines, p)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for text := range texts {
-			stream, err := say(svc, voice, text)
+	var phrases []string
+	boosted := false
+	for _, line := range lines {
+		p, boost, err := parsePhrase(line)
+		if err != nil {
+			return nil, err
+		}
+		if boost != defaultPhraseBoost {
+			boosted = true
+		}
+		phrases = append(phrases, p)
+	}
+	if boosted {
+		// the v1 speech context only has the phrases, without weights.
+		warnf("the speech api in use can't boost phrases, they're all weighted the same")
+	}
+	return phrases, nil
+}
+
+// defaultPhraseBoost is the boost of a phrase that doesn't have one.
+const defaultPhraseBoost = 0
+
+// parsePhrase parses a phrase with an optional boost, as 'phrase:boost'. A
+// phrase whose text after the last ':' isn't a number, or whose text right
+// before it is a digit, has no boost, so that times like 'at 10:30' are kept
+// as they are. A phrase ending in a digit is boosted as 'room 101 :2'.
+func parsePhrase(s string) (string, float64, error) {
+	i := strings.LastIndex(s, ":")
+	if i < 0 || i > 0 && unicode.IsDigit(rune(s[i-1])) {
+		return s, defaultPhraseBoost, nil
+	}
+	boost, err := strconv.ParseFloat(strings.TrimSpace(s[i+1:]), 64)
+	if err != nil {
+		return s, defaultPhraseBoost, nil
+	}
+	p := strings.TrimSpace(s[:i])
+	if p == "" {
+		return "", 0, fmt.Errorf("Invalid phrase %q, it has a boost but no phrase", s)
+	}
+	if math.IsNaN(boost) || math.IsInf(boost, 0) {
+		return "", 0, fmt.Errorf("Invalid boost of phrase %q", s)
+	}
+	return p, boost, nil
+}
+
+// newRecognizer starts recognizing the configured input, with a session
+// per channel.
+func newRecognizer(ctx context.Context, client *speech.Client, encoding speechpb.RecognitionConfig_AudioEncoding, phrases []string) (echo.Recognizer, error) {
+	recs := make([]echo.Recognizer, opts.channels)
+	for i := range recs {
+		if opts.sttBackend == "azure" {
+			recs[i] = NewAzureRecognizer(ctx, opts.azureRegion, opts.azureKey, opts.language, opts.sampleRate, opts.vadThreshold)
+		} else {
+			err := retryStartup(ctx, "start recognizing", opts.startRetries, func() (err error) {
+				recs[i], err = NewGoogleRecognizer(ctx, client, streamingConfig(opts.language, encoding, phrases), opts.maxSession, opts.recvTimeout)
+				return err
+			})
 			if err != nil {
-				break
+				return nil, err
 			}
-			streams <- stream
 		}
-		close(streams)
-	}()
+		if opts.vad {
+			recs[i] = newVADRecognizer(recs[i], opts.vadThreshold, opts.sampleRate)
+		}
+	}
+	rec := recs[0]
+	if len(recs) > 1 {
+		rec = newChannelRecognizer(ctx, recs)
+	}
+	events.configSent()
+
+	rec = meteredRecognizer{rec}
+	if events != nil {
+		rec = newEventRecognizer(ctx, rec)
+	}
+	return rec, nil
+}
+
+// writeTranscript appends a line with the time and transcript of res to
+// file and syncs it so that it survives a crash.
+func writeTranscript(file *os.File, res echo.Result) error {
+	_, err := fmt.Fprintf(file, "%s\t%s\n", res.Timestamp.Format(time.RFC3339), res.Transcript)
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// writeSample writes the speech of the sample text to the sample clip.
+func writeSample(ctx context.Context, synth echo.Synthesizer, ssml *ssmlTemplate) error {
+	text := opts.sampleText
+	if ssml != nil {
+		wrapped, err := ssml.Wrap(text)
+		if err != nil {
+			return fmt.Errorf("Could not wrap sample text: %v", err)
+		}
+		text = wrapped
+	}
+	audio, err := synth.Synthesize(ctx, text)
+	if err != nil {
+		return fmt.Errorf("Could not synthesize sample: %v", err)
+	}
+	defer audio.Close()
+	file, err := os.Create(opts.sampleClip)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, audio); err != nil {
+		file.Close()
+		return fmt.Errorf("Could not write sample: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	infof("wrote sample to %s", opts.sampleClip)
+	return nil
+}
+
+// isTerminal reports whether f is an interactive terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// readCloser reads from a Reader and closes a Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// stopAfter calls stop once d has passed, unless the timer is stopped.
+func stopAfter(d time.Duration, stop func()) echo.Timer {
+	return clock.AfterFunc(d, func() {
+		infof("stopping after %s", d)
+		stop()
+	})
+}
+
+// stopReader reads from an io.ReadCloser until stopped is closed.
+type stopReader struct {
+	io.ReadCloser
+	stopped <-chan struct{}
+}
+
+func (r stopReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.stopped:
+		return 0, io.EOF
+	default:
+		n, err := r.ReadCloser.Read(p)
+		if err != nil && err != io.EOF {
+			stats.addError("capture")
+		}
+		return n, err
+	}
+}
+
+// capture starts recording from the default input device with sox. Pressing
+// 'Enter' calls stop, and the recording ends once stopped is closed. Pressing
+// 'Space' pauses sending the recording, until another key is pressed.
+func capture(ctx context.Context, c codec, stop func(), stopped <-chan struct{}) (io.ReadCloser, error) {
+	path, err := exec.LookPath(opts.soxPath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not find capture command %s: %v", opts.soxPath, err)
+	}
+	args, err := captureCommandArgs(c)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("start: %v", err)
+	}
+
+	paused := &pauseReader{r: out}
+	restore := func() {}
+	// not part of the pipeline as reading stdin can't be cancelled.
+	if !opts.noPrompt && isTerminal(os.Stdin) {
+		var raw func()
+		var err error
+		if c.sampleSize == 0 {
+			// dropping the audio of a compressed stream would corrupt it.
+			err = fmt.Errorf("the %s codec can't be paused", opts.codec)
+		} else {
+			raw, err = rawTerminal()
+		}
+		if err != nil {
+			warnf("Could not read keys as they're pressed, pausing is disabled: %v", err)
+			go func() {
+				fmt.Fprintln(os.Stderr, "Press 'Enter' to stop")
+				bufio.NewReader(os.Stdin).ReadBytes('\n')
+				stop()
+			}()
+		} else {
+			restore = raw
+			go func() {
+				fmt.Fprintln(os.Stderr, "Press 'Enter' to stop, 'Space' to pause and any key to resume")
+				readKeys(bufio.NewReader(os.Stdin), paused, stop)
+			}()
+		}
+	}
 
-	wg.Add(1)
 	go func() {
-		defer wg.Done()
-		for stream := range streams {
-			now := time.Now().Format(time.UnixDate)
-			name := "./tmp/" + now + ".mp3"
-			file, err := os.Create(name)
+		defer restore()
+		select {
+		case <-stopped:
+			err := cmd.Process.Signal(os.Interrupt)
 			if err != nil {
-				log.Fatal(err)
-				break
+				errorf("Could not stop recording: %v", err)
 			}
-			defer file.Close()
-			_, err = io.Copy(file, stream)
-			defer stream.Close()
-			log.Printf("wrote audio to " + name)
+		case <-ctx.Done():
 		}
 	}()
 
-	wg.Wait()
+	return captureReader{readCloser{paused, out}, cmd, restore}, nil
+}
+
+// captureCommandArgs returns the arguments of the command that records c
+// from the default input device to stdout, with the effects of
+// --sox-effects, or those of --capture-args.
+func captureCommandArgs(c codec) ([]string, error) {
+	if opts.captureArgs != "" {
+		return strings.Fields(opts.captureArgs), nil
+	}
+	args := []string{"-d", "-r", strconv.Itoa(opts.sampleRate), "-c", strconv.Itoa(opts.channels)}
+	args = append(append(args, c.soxArgs...), "-")
+	effects, err := soxEffects(opts.soxEffects)
+	if err != nil {
+		return nil, err
+	}
+	return append(args, effects...), nil
+}
+
+// captureReader reads the audio of a capture command. Closing it waits for
+// the command to exit.
+type captureReader struct {
+	io.ReadCloser
+	cmd     *exec.Cmd
+	restore func()
+}
+
+func (r captureReader) Close() error {
+	r.restore()
+	// drain what's left of the recording so that the command isn't blocked
+	// writing it.
+	io.Copy(ioutil.Discard, r.ReadCloser)
+	if err := r.cmd.Wait(); err != nil {
+		return fmt.Errorf("wait: %v", err)
+	}
+	return nil
+}
+
+// soxEffects splits an effects chain into arguments for sox. The chain must
+// start with an effect, and can't split the output as the recording is
+// read as one stream.
+func soxEffects(s string) ([]string, error) {
+	args := strings.Fields(s)
+	if len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		return nil, fmt.Errorf("Invalid --sox-effects %q, it must start with an effect", s)
+	}
+	for _, arg := range args {
+		switch arg {
+		case ":", "newfile", "restart":
+			return nil, fmt.Errorf("Invalid --sox-effects %q, %s can't be used", s, arg)
+		}
+	}
+	return args, nil
+}
+
+// newSession creates an aws session for the configured region and profile,
+// falling back to the environment for anything that isn't set.
+func newSession() (*session.Session, error) {
+	o := session.Options{
+		Profile:           opts.awsProfile,
+		SharedConfigState: session.SharedConfigEnable,
+	}
+	if opts.awsRegion != "" {
+		o.Config.Region = aws.String(opts.awsRegion)
+	}
+	sess, err := session.NewSessionWithOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAWSCredentials(sess); err != nil {
+		return nil, err
+	}
+	return sess, nil
 }
 
-func say(svc *polly.Polly, voice string, text string) (io.ReadCloser, error) {
-	log.Printf("saying '%s'", text)
-	input := &polly.SynthesizeSpeechInput{
-		OutputFormat: aws.String("mp3"),
-		SampleRate:   aws.String("8000"),
-		Text:         aws.String(text),
-		TextType:     aws.String("text"),
-		VoiceId:      aws.String(voice),
+// selectVoice picks the voice with the given id or, if id is empty, the
+// first of the available voices.
+func selectVoice(voices []*polly.Voice, language, id string) (string, error) {
+	if len(voices) == 0 {
+		return "", fmt.Errorf("Polly has no voices for %s, check that it's a language code like en-US, and list the voices of a language with --list-voices", language)
+	}
+	if id == "" {
+		return *voices[0].Id, nil
+	}
+	ids := make([]string, 0, len(voices))
+	for _, v := range voices {
+		if *v.Id == id {
+			return id, nil
+		}
+		ids = append(ids, *v.Id)
 	}
+	return "", fmt.Errorf("Invalid voice %s for %s, available voices: %s", id, language, strings.Join(ids, ", "))
+}
 
-	result, err := svc.SynthesizeSpeech(input)
+// fileName returns a filesystem safe name for the seq:th utterance of a
+// session started at start, suffixed with the channel, if it's not 0, and
+// the first few words of text.
+func fileName(start time.Time, seq, channel int, text string) string {
+	name := fmt.Sprintf("%s-%04d", start.Format("20060102T150405"), seq)
+	if channel != 0 {
+		name += fmt.Sprintf("-ch%d", channel)
+	}
+	if slug := slugify(text, 5); slug != "" {
+		name += "-" + slug
+	}
+	return name
+}
+
+// slugify lowercases the first n words of text and joins them with dashes,
+// dropping anything but letters and digits.
+func slugify(text string, n int) string {
+	var words []string
+	for _, w := range strings.Fields(text) {
+		w = strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				return unicode.ToLower(r)
+			}
+			return -1
+		}, w)
+		if w == "" {
+			continue
+		}
+		words = append(words, w)
+		if len(words) == n {
+			break
+		}
+	}
+	return strings.Join(words, "-")
+}
+
+// newSynthesizer creates the configured synthesizer speaking language.
+func newSynthesizer(language string) (echo.Synthesizer, error) {
+	var synth echo.Synthesizer
+	var err error
+	switch {
+	case opts.dryRun:
+		infof("dry run, not synthesizing any speech")
+		synth = nopSynthesizer{}
+	case opts.ttsBackend == "espeak":
+		voice := opts.voice
+		if voice == "" {
+			voice = baseLanguage(language)
+		}
+		synth, err = NewEspeakSynthesizer(voice)
+	case opts.ttsBackend == "azure":
+		synth, err = NewAzureSynthesizer(context.Background(), opts.azureRegion, opts.azureKey, language, synthDefaults(opts.voice))
+	default:
+		synth, err = setupPolly(language)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return result.AudioStream, nil
+	if opts.ttsTimeout > 0 {
+		synth = timeoutSynthesizer{synth, opts.ttsTimeout}
+	}
+	if opts.ttsRetries > 0 {
+		synth = retrySynthesizer{synth, opts.ttsRetries, 200 * time.Millisecond}
+	}
+	synth = meteredSynthesizer{synth}
+	if events != nil {
+		synth = eventSynthesizer{synth}
+	}
+	return synth, nil
+}
+
+// synthesizers creates a synthesizer per language on first use.
+type synthesizers struct {
+	mu     sync.Mutex
+	synths map[string]echo.Synthesizer
+}
+
+// newSynthesizers creates the synthesizers, starting with synth for
+// language.
+func newSynthesizers(language string, synth echo.Synthesizer) *synthesizers {
+	return &synthesizers{synths: map[string]echo.Synthesizer{language: synth}}
+}
+
+// get returns the synthesizer for language.
+func (s *synthesizers) get(language string) (echo.Synthesizer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if synth, ok := s.synths[language]; ok {
+		return synth, nil
+	}
+	synth, err := newSynthesizer(language)
+	if err != nil {
+		return nil, err
+	}
+	s.synths[language] = synth
+	return synth, nil
+}
+
+// setupPolly creates a polly synthesizer speaking language with the
+// configured voice.
+func setupPolly(language string) (*PollySynthesizer, error) {
+	sess, err := newSession()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create aws session: %w", err)
+	}
+	infof("using polly in %s", aws.StringValue(sess.Config.Region))
+
+	svc := polly.New(sess)
+	if err := checkLexicons(svc, opts.lexicons); err != nil {
+		return nil, err
+	}
+	voices, err := describeVoices(svc, language)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get voices: %v", err)
+	}
+	voice, err := selectVoice(voices, language, opts.voice)
+	if err != nil {
+		return nil, err
+	}
+	return NewPollySynthesizer(sess, synthDefaults(voice))
+}
+
+// synthDefaults returns the configured settings of syntheses with voice.
+func synthDefaults(voice string) SynthOptions {
+	o := SynthOptions{
+		Voice:      voice,
+		Format:     opts.outFormat,
+		SampleRate: opts.ttsRate,
+		Lexicons:   opts.lexicons,
+	}
+	if opts.ssml {
+		o.TextType = "ssml"
+	}
+	return o
+}
+
+// listVoices writes a table of the voices for language to w. If there are
+// none it suggests the language codes that do have voices instead.
+func listVoices(w io.Writer, svc *polly.Polly, language string) error {
+	voices, err := describeVoices(svc, language)
+	if err != nil {
+		return fmt.Errorf("Failed to get voices: %v", err)
+	}
+	if len(voices) == 0 {
+		resp, err := svc.DescribeVoices(&polly.DescribeVoicesInput{})
+		if err != nil {
+			return fmt.Errorf("Failed to get voices: %v", err)
+		}
+		var codes []string
+		seen := map[string]bool{}
+		for _, v := range resp.Voices {
+			if code := *v.LanguageCode; !seen[code] {
+				seen[code] = true
+				codes = append(codes, code)
+			}
+		}
+		sort.Strings(codes)
+		return fmt.Errorf("No voices for %s, try one of: %s", language, strings.Join(codes, ", "))
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tGENDER")
+	for _, v := range voices {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", *v.Id, *v.Name, *v.Gender)
+	}
+	return tw.Flush()
+}
+
+// playCommand returns sox's play command for playing audio in format from
+// stdin.
+func playCommand(format string, sampleRate int) *exec.Cmd {
+	args := append([]string{"-q"}, soxFormatArgs(format, sampleRate)...)
+	cmd := exec.Command("play", append(args, "-")...)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// soxFormatArgs returns the sox arguments for audio in the output format.
+func soxFormatArgs(format string, sampleRate int) []string {
+	switch format {
+	case "ogg_vorbis":
+		return []string{"-t", "ogg"}
+	case "pcm":
+		return []string{"-t", "raw", "-r", strconv.Itoa(sampleRate), "-e", "signed", "-b", "16", "-L", "-c", "1"}
+	default:
+		return []string{"-t", format}
+	}
 }
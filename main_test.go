@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/slaskis/cloud-echo/echo"
+	"github.com/slaskis/cloud-echo/echo/echotest"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+)
+
+// setOpts changes the options for the rest of a test.
+func setOpts(t *testing.T, change func(o *options)) {
+	old := opts
+	change(&opts)
+	t.Cleanup(func() { opts = old })
+}
+
+func TestNewEcho(t *testing.T) {
+	ssml, err := parseSSMLTemplate("<speak>{{.}}</speak>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name   string
+		change func(o *options)
+		ssml   *ssmlTemplate
+		text   string
+		want   string
+	}{
+		{"plain", func(o *options) {}, nil, "hi", "hi"},
+		{"prefix and suffix", func(o *options) { o.echoPrefix, o.echoSuffix = "you said ", "!" }, nil, "hi", "you said hi!"},
+		{"ssml", func(o *options) {}, ssml, "a & b", "<speak>a &amp; b</speak>"},
+		{"prefix and ssml", func(o *options) { o.echoPrefix = "<" }, ssml, "hi", "<speak>&lt;hi</speak>"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setOpts(t, c.change)
+			e := newEcho(nil, nil, newSynthesizers("", nil), nil, c.ssml)
+			got := c.text
+			if e.Wrap != nil {
+				var err error
+				if got, err = e.Wrap(c.text); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got != c.want {
+				t.Errorf("wrapped %q as %q, want %q", c.text, got, c.want)
+			}
+		})
+	}
+}
+
+func TestNewEchoOptions(t *testing.T) {
+	setOpts(t, func(o *options) {
+		o.minConf = 0.5
+		o.dedupWindow = time.Second
+		o.interim = true
+		o.single = true
+		o.ttsWorkers = 3
+	})
+	e := newEcho(nil, nil, newSynthesizers("", nil), nil, nil)
+	if e.MinConfidence != 0.5 || e.DedupWindow != time.Second || !e.Interim || !e.Single || e.Concurrency != 3 {
+		t.Errorf("echo doesn't have the options: %+v", e)
+	}
+	if e.Wrap != nil {
+		t.Errorf("echo wraps without a prefix, suffix or ssml")
+	}
+}
+
+func TestFileName(t *testing.T) {
+	start := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+	cases := []struct {
+		seq, channel int
+		text         string
+		want         string
+	}{
+		{1, 0, "Hello world", "20200304T050607-0001-hello-world"},
+		{12, 0, "", "20200304T050607-0012"},
+		{3, 2, "hi", "20200304T050607-0003-ch2-hi"},
+		{4, 0, "one two three four five six", "20200304T050607-0004-one-two-three-four-five"},
+		{5, 0, "What's up? ... Nothing!", "20200304T050607-0005-whats-up-nothing"},
+		{6, 0, "Grüß Gott", "20200304T050607-0006-grüß-gott"},
+		{7, 0, "?!", "20200304T050607-0007"},
+		{8, 0, "../../etc/passwd", "20200304T050607-0008-etcpasswd"},
+	}
+	for _, c := range cases {
+		if got := fileName(start, c.seq, c.channel, c.text); got != c.want {
+			t.Errorf("fileName(%d, %d, %q) = %s, want %s", c.seq, c.channel, c.text, got, c.want)
+		}
+	}
+}
+
+func TestParsePhrase(t *testing.T) {
+	cases := []struct {
+		s      string
+		phrase string
+		boost  float64
+		err    bool
+	}{
+		{"hello", "hello", defaultPhraseBoost, false},
+		{"hello:5", "hello", 5, false},
+		{"hello world : 2.5", "hello world", 2.5, false},
+		{"10:30", "10:30", defaultPhraseBoost, false},
+		{"at 10:30", "at 10:30", defaultPhraseBoost, false},
+		{"at 10:30 :4", "at 10:30", 4, false},
+		{"room 101:2", "room 101:2", defaultPhraseBoost, false},
+		{"note: this", "note: this", defaultPhraseBoost, false},
+		{":5", "", 0, true},
+		{"hello:NaN", "", 0, true},
+		{"hello:Inf", "", 0, true},
+	}
+	for _, c := range cases {
+		phrase, boost, err := parsePhrase(c.s)
+		if (err != nil) != c.err {
+			t.Errorf("parsePhrase(%q) error = %v, want error %v", c.s, err, c.err)
+			continue
+		}
+		if phrase != c.phrase || boost != c.boost {
+			t.Errorf("parsePhrase(%q) = %q, %v, want %q, %v", c.s, phrase, boost, c.phrase, c.boost)
+		}
+	}
+}
+
+func TestStreamingConfig(t *testing.T) {
+	cases := []struct {
+		name    string
+		change  func(o *options)
+		phrases []string
+		want    *speechpb.StreamingRecognitionConfig
+	}{
+		{
+			name:   "defaults",
+			change: func(o *options) {},
+			want: &speechpb.StreamingRecognitionConfig{
+				Config: &speechpb.RecognitionConfig{LanguageCode: "en-US", Encoding: speechpb.RecognitionConfig_LINEAR16, SampleRateHertz: 16000},
+			},
+		},
+		{
+			name:   "alternatives and words",
+			change: func(o *options) { o.maxAlts = 3; o.wordTimings = true },
+			want: &speechpb.StreamingRecognitionConfig{
+				Config: &speechpb.RecognitionConfig{
+					LanguageCode:          "en-US",
+					Encoding:              speechpb.RecognitionConfig_LINEAR16,
+					SampleRateHertz:       16000,
+					MaxAlternatives:       3,
+					EnableWordTimeOffsets: true,
+				},
+			},
+		},
+		{
+			name:    "phrases and profanity",
+			change:  func(o *options) { o.profanity = true },
+			phrases: []string{"cloud echo"},
+			want: &speechpb.StreamingRecognitionConfig{
+				Config: &speechpb.RecognitionConfig{
+					LanguageCode:    "en-US",
+					Encoding:        speechpb.RecognitionConfig_LINEAR16,
+					SampleRateHertz: 16000,
+					ProfanityFilter: true,
+					SpeechContexts:  []*speechpb.SpeechContext{{Phrases: []string{"cloud echo"}}},
+				},
+			},
+		},
+		{
+			name:   "speech timeout needs interims",
+			change: func(o *options) { o.speechTimeout = time.Second; o.single = true },
+			want: &speechpb.StreamingRecognitionConfig{
+				Config:          &speechpb.RecognitionConfig{LanguageCode: "en-US", Encoding: speechpb.RecognitionConfig_LINEAR16, SampleRateHertz: 16000},
+				InterimResults:  true,
+				SingleUtterance: true,
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setOpts(t, func(o *options) {
+				*o = options{sampleRate: 16000}
+				c.change(o)
+			})
+			got := streamingConfig("en-US", speechpb.RecognitionConfig_LINEAR16, c.phrases)
+			if !proto.Equal(got, c.want) {
+				t.Errorf("streamingConfig() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestLoadPhrases(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "phrases.txt")
+	if err := ioutil.WriteFile(file, []byte("cloud echo\n\n  polly  \nat 10:30\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name    string
+		phrases string
+		file    string
+		want    []string
+	}{
+		{"none", "", "", nil},
+		{"flag", "hello, world,,", "", []string{"hello", "world"}},
+		{"file", "", file, []string{"cloud echo", "polly", "at 10:30"}},
+		{"both", "hello:5", file, []string{"hello", "cloud echo", "polly", "at 10:30"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setOpts(t, func(o *options) { o.phrases, o.phrasesFile = c.phrases, c.file })
+			got, err := loadPhrases()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("phrases = %q, want %q", got, c.want)
+			}
+		})
+	}
+	setOpts(t, func(o *options) { o.phrasesFile = filepath.Join(t.TempDir(), "missing") })
+	if _, err := loadPhrases(); err == nil {
+		t.Error("loaded phrases from a missing file")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"error", errors.New("broken"), exitError},
+		{"google credentials", authError{errors.New("no google credentials")}, exitAuth},
+		{"wrapped credentials", fmt.Errorf("Failed to start: %w", authError{errors.New("no aws credentials")}), exitAuth},
+		{"capture", echo.CaptureError{Err: errors.New("no microphone")}, exitCapture},
+		{"recognize", echo.RecognizeError{Err: errors.New("stream broke")}, exitRecognize},
+		{"synthesize", echo.SynthesizeError{Err: errors.New("no voice")}, exitSynthesize},
+		{"output", echo.OutputError{Err: errors.New("disk full")}, exitOutput},
+		{"wrapped output", fmt.Errorf("Could not finish: %w", echo.OutputError{Err: errors.New("disk full")}), exitOutput},
+		{"credentials of a stage", echo.RecognizeError{Err: authError{errors.New("expired")}}, exitAuth},
+	}
+	for _, c := range cases {
+		if got := exitCode(c.err); got != c.want {
+			t.Errorf("%s: exitCode(%v) = %d, want %d", c.name, c.err, got, c.want)
+		}
+	}
+}
+
+func TestRunExitCode(t *testing.T) {
+	broken := errors.New("broken")
+	cases := []struct {
+		name   string
+		rec    *echotest.Recognizer
+		input  io.Reader
+		writer echo.Writer
+		want   int
+	}{
+		{"recognizer", echotest.NewRecognizer(broken, echo.Result{Transcript: "hello", IsFinal: true}), strings.NewReader("audio"), &echotest.Writer{}, exitRecognize},
+		{"recognizer credentials", echotest.NewRecognizer(authError{broken}), strings.NewReader("audio"), &echotest.Writer{}, exitAuth},
+		{"capture", echotest.NewRecognizer(nil), iotest.ErrReader(broken), &echotest.Writer{}, exitCapture},
+		{"output", echotest.NewRecognizer(nil, echo.Result{Transcript: "hello", IsFinal: true}), strings.NewReader("audio"), echo.WriterFunc(func(string, io.Reader) error { return broken }), exitOutput},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			useStats(t, nil)
+			defer c.rec.Close()
+			e := newEcho(meteredRecognizer{c.rec}, &echotest.Synthesizer{}, newSynthesizers("", nil), nil, nil)
+			e.Writer = meteredWriter{c.writer}
+			err := e.Run(context.Background(), c.input)
+			if got := exitCode(err); got != c.want {
+				t.Errorf("Run() = %v, exiting with %d, want %d", err, got, c.want)
+			}
+		})
+	}
+}
+
+// endless reads silence forever.
+type endless struct{}
+
+func (endless) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func (endless) Close() error { return nil }
+
+func TestStopAfter(t *testing.T) {
+	c := echotest.NewClock(time.Unix(0, 0))
+	useClock(t, c)
+	stopped := make(chan struct{})
+	var once sync.Once
+	stop := func() { once.Do(func() { close(stopped) }) }
+
+	stopAfter(time.Minute, stop)
+	r := stopReader{endless{}, stopped}
+	p := make([]byte, 10)
+	if n, err := r.Read(p); n == 0 || err != nil {
+		t.Fatalf("Read() = %d, %v before the time was up", n, err)
+	}
+	c.Advance(time.Minute - time.Nanosecond)
+	if n, err := r.Read(p); n == 0 || err != nil {
+		t.Fatalf("Read() = %d, %v a moment before the time was up", n, err)
+	}
+	c.Advance(time.Nanosecond)
+	if n, err := io.Copy(ioutil.Discard, r); n != 0 || err != nil {
+		t.Errorf("read %d bytes, %v once the time was up, want the end of the input", n, err)
+	}
+}
+
+func TestStopAfterStopped(t *testing.T) {
+	c := echotest.NewClock(time.Unix(0, 0))
+	useClock(t, c)
+	stopped := false
+	timer := stopAfter(time.Minute, func() { stopped = true })
+	if !timer.Stop() {
+		t.Fatal("the timer had fired")
+	}
+	c.Advance(time.Hour)
+	if stopped {
+		t.Error("stopped after the timer was stopped")
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/slaskis/cloud-echo/echo"
+)
+
+// latencyBuckets are the upper bounds in seconds of the synthesis latency
+// histogram.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metrics counts what goes on in the pipeline. All methods are no-ops on a
+// nil *metrics, so instrumentation costs nothing when metrics are disabled.
+type metrics struct {
+	audioBytes  uint64
+	transcripts uint64
+	clips       uint64
+	speechBytes uint64
+
+	mu           sync.Mutex
+	errors       map[string]uint64
+	latencyCount []uint64
+	latencySum   float64
+	latencyTotal uint64
+}
+
+// stats counts the pipeline of the command, for the metrics endpoint and
+// the summary at shutdown.
+var stats *metrics
+
+func newMetrics() *metrics {
+	return &metrics{
+		errors:       map[string]uint64{},
+		latencyCount: make([]uint64, len(latencyBuckets)),
+	}
+}
+
+func (m *metrics) addAudio(n int) {
+	if m != nil {
+		atomic.AddUint64(&m.audioBytes, uint64(n))
+	}
+}
+
+func (m *metrics) addTranscript() {
+	if m != nil {
+		atomic.AddUint64(&m.transcripts, 1)
+	}
+}
+
+// addSpeech counts an utterance of n bytes of speech that was output.
+func (m *metrics) addSpeech(n int) {
+	if m != nil {
+		atomic.AddUint64(&m.clips, 1)
+		atomic.AddUint64(&m.speechBytes, uint64(n))
+	}
+}
+
+// addError counts an error in a stage of the pipeline, such as "capture",
+// "recognize", "synthesize" or "output".
+func (m *metrics) addError(stage string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.errors[stage]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) observeSynthesis(d time.Duration) {
+	if m == nil {
+		return
+	}
+	s := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, le := range latencyBuckets {
+		if s <= le {
+			m.latencyCount[i]++
+		}
+	}
+	m.latencySum += s
+	m.latencyTotal++
+}
+
+// ServeHTTP writes the metrics in the prometheus text format.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP cloud_echo_audio_bytes_total Bytes of audio sent to the recognizer.")
+	fmt.Fprintln(w, "# TYPE cloud_echo_audio_bytes_total counter")
+	fmt.Fprintf(w, "cloud_echo_audio_bytes_total %d\n", atomic.LoadUint64(&m.audioBytes))
+
+	fmt.Fprintln(w, "# HELP cloud_echo_transcripts_total Transcripts received from the recognizer.")
+	fmt.Fprintln(w, "# TYPE cloud_echo_transcripts_total counter")
+	fmt.Fprintf(w, "cloud_echo_transcripts_total %d\n", atomic.LoadUint64(&m.transcripts))
+
+	fmt.Fprintln(w, "# HELP cloud_echo_clips_total Utterances of speech that were output.")
+	fmt.Fprintln(w, "# TYPE cloud_echo_clips_total counter")
+	fmt.Fprintf(w, "cloud_echo_clips_total %d\n", atomic.LoadUint64(&m.clips))
+
+	fmt.Fprintln(w, "# HELP cloud_echo_speech_bytes_total Bytes of speech that were output.")
+	fmt.Fprintln(w, "# TYPE cloud_echo_speech_bytes_total counter")
+	fmt.Fprintf(w, "cloud_echo_speech_bytes_total %d\n", atomic.LoadUint64(&m.speechBytes))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP cloud_echo_errors_total Errors per stage of the pipeline.")
+	fmt.Fprintln(w, "# TYPE cloud_echo_errors_total counter")
+	stages := make([]string, 0, len(m.errors))
+	for stage := range m.errors {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	for _, stage := range stages {
+		fmt.Fprintf(w, "cloud_echo_errors_total{stage=%q} %d\n", stage, m.errors[stage])
+	}
+
+	fmt.Fprintln(w, "# HELP cloud_echo_synthesis_seconds Time until synthesized speech starts streaming.")
+	fmt.Fprintln(w, "# TYPE cloud_echo_synthesis_seconds histogram")
+	for i, le := range latencyBuckets {
+		fmt.Fprintf(w, "cloud_echo_synthesis_seconds_bucket{le=\"%g\"} %d\n", le, m.latencyCount[i])
+	}
+	fmt.Fprintf(w, "cloud_echo_synthesis_seconds_bucket{le=\"+Inf\"} %d\n", m.latencyTotal)
+	fmt.Fprintf(w, "cloud_echo_synthesis_seconds_sum %g\n", m.latencySum)
+	fmt.Fprintf(w, "cloud_echo_synthesis_seconds_count %d\n", m.latencyTotal)
+}
+
+// meteredSynthesizer records the latency and errors of a Synthesizer.
+type meteredSynthesizer struct {
+	echo.Synthesizer
+}
+
+// Synthesize implements echo.Synthesizer.
+func (s meteredSynthesizer) Synthesize(ctx context.Context, text string) (io.ReadCloser, error) {
+	start := time.Now()
+	audio, err := s.Synthesizer.Synthesize(ctx, text)
+	if err != nil {
+		stats.addError("synthesize")
+		return nil, err
+	}
+	stats.observeSynthesis(time.Since(start))
+	return audio, nil
+}
+
+// meteredWriter counts the speech output by a Writer.
+type meteredWriter struct {
+	echo.Writer
+}
+
+// WriteSpeech implements echo.Writer.
+func (w meteredWriter) WriteSpeech(text string, audio io.Reader) error {
+	c := &echo.CountingReader{R: audio}
+	if err := w.Writer.WriteSpeech(text, c); err != nil {
+		return err
+	}
+	stats.addSpeech(c.N)
+	return nil
+}
+
+// Interrupt implements echo.Interrupter if the underlying Writer does.
+func (w meteredWriter) Interrupt() {
+	if i, ok := w.Writer.(echo.Interrupter); ok {
+		i.Interrupt()
+	}
+}
+
+// summary returns a line summing up a session of elapsed time, in which
+// transcripts were echoed. The audio sent is in seconds for codecs of
+// sampleSize bytes per sample, and in bytes for those that are compressed.
+func (m *metrics) summary(elapsed time.Duration, transcripts, sampleSize int) string {
+	audio := atomic.LoadUint64(&m.audioBytes)
+	sent := fmt.Sprintf("%d bytes", audio)
+	if sampleSize > 0 {
+		seconds := float64(audio) / float64(sampleSize*opts.channels*opts.sampleRate)
+		sent = fmt.Sprintf("%.1fs", seconds)
+	}
+	return fmt.Sprintf("sent %s of audio, echoed %d transcripts in %d clips of %d bytes, in %s",
+		sent, transcripts, atomic.LoadUint64(&m.clips), atomic.LoadUint64(&m.speechBytes), elapsed.Round(time.Second))
+}
+
+// meteredRecognizer counts the audio sent to a Recognizer.
+type meteredRecognizer struct {
+	echo.Recognizer
+}
+
+// SendAudio implements echo.Recognizer.
+func (r meteredRecognizer) SendAudio(audio []byte) error {
+	if err := r.Recognizer.SendAudio(audio); err != nil {
+		stats.addError("recognize")
+		return err
+	}
+	stats.addAudio(len(audio))
+	return nil
+}
+
+// meteredTranslator counts the errors of a Translator.
+type meteredTranslator struct {
+	echo.Translator
+}
+
+// Translate implements echo.Translator.
+func (t meteredTranslator) Translate(ctx context.Context, text string) (string, error) {
+	translated, err := t.Translator.Translate(ctx, text)
+	if err != nil {
+		stats.addError("translate")
+	}
+	return translated, err
+}
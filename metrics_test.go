@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slaskis/cloud-echo/echo/echotest"
+)
+
+// useStats counts the metrics of the rest of a test in m.
+func useStats(t *testing.T, m *metrics) {
+	old := stats
+	stats = m
+	t.Cleanup(func() { stats = old })
+}
+
+func TestMetricsServeHTTP(t *testing.T) {
+	m := newMetrics()
+	m.addAudio(100)
+	m.addAudio(28)
+	m.addTranscript()
+	m.addSpeech(1000)
+	m.addError("synthesize")
+	m.addError("output")
+	m.addError("output")
+	m.observeSynthesis(300 * time.Millisecond)
+	m.observeSynthesis(3 * time.Second)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		"cloud_echo_audio_bytes_total 128",
+		"cloud_echo_transcripts_total 1",
+		"cloud_echo_clips_total 1",
+		"cloud_echo_speech_bytes_total 1000",
+		`cloud_echo_errors_total{stage="output"} 2`,
+		`cloud_echo_errors_total{stage="synthesize"} 1`,
+		`cloud_echo_synthesis_seconds_bucket{le="0.25"} 0`,
+		`cloud_echo_synthesis_seconds_bucket{le="0.5"} 1`,
+		`cloud_echo_synthesis_seconds_bucket{le="5"} 2`,
+		`cloud_echo_synthesis_seconds_bucket{le="+Inf"} 2`,
+		"cloud_echo_synthesis_seconds_sum 3.3",
+		"cloud_echo_synthesis_seconds_count 2",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics don't have %s:\n%s", line, body)
+		}
+	}
+	if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+		t.Errorf("Content-Type = %s, want text/plain", got)
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *metrics
+	m.addAudio(1)
+	m.addTranscript()
+	m.addSpeech(1)
+	m.addError("output")
+	m.observeSynthesis(time.Second)
+}
+
+func TestMeteredPipeline(t *testing.T) {
+	m := newMetrics()
+	useStats(t, m)
+	synth := meteredSynthesizer{&echotest.Synthesizer{Errors: map[string]error{"broken": errors.New("no voice")}}}
+	w := meteredWriter{&echotest.Writer{}}
+	for _, text := range []string{"hello", "broken", "world"} {
+		audio, err := synth.Synthesize(context.Background(), text)
+		if err != nil {
+			continue
+		}
+		if err := w.WriteSpeech(text, audio); err != nil {
+			t.Fatal(err)
+		}
+		audio.Close()
+	}
+	if m.clips != 2 || m.speechBytes != 10 || m.latencyTotal != 2 || m.errors["synthesize"] != 1 {
+		t.Errorf("counted %d clips of %d bytes, %d syntheses and %d errors, want 2 of 10, 2 and 1",
+			m.clips, m.speechBytes, m.latencyTotal, m.errors["synthesize"])
+	}
+}
+
+func TestMetricsSummary(t *testing.T) {
+	setOpts(t, func(o *options) { o.channels, o.sampleRate = 1, 16000 })
+	m := newMetrics()
+	m.addAudio(64000)
+	m.addSpeech(500)
+	cases := []struct {
+		sampleSize int
+		want       string
+	}{
+		{2, "sent 2.0s of audio, echoed 3 transcripts in 1 clips of 500 bytes, in 1m0s"},
+		{0, "sent 64000 bytes of audio, echoed 3 transcripts in 1 clips of 500 bytes, in 1m0s"},
+	}
+	for _, c := range cases {
+		if got := m.summary(time.Minute, 3, c.sampleSize); got != c.want {
+			t.Errorf("summary = %q, want %q", got, c.want)
+		}
+	}
+}
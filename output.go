@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/slaskis/cloud-echo/echo"
+)
+
+// fileWriter writes each utterance to a numbered file in dir.
+type fileWriter struct {
+	dir   string
+	ext   string
+	start time.Time
+	seq   int
+}
+
+// WriteSpeech implements echo.Writer.
+func (w *fileWriter) WriteSpeech(text string, audio io.Reader) error {
+	return w.write(0, text, audio)
+}
+
+func (w *fileWriter) write(channel int, text string, audio io.Reader) error {
+	w.seq++
+	name := filepath.Join(w.dir, fileName(w.start, w.seq, channel, text)+w.ext)
+	file, err := os.Create(name)
+	if err != nil {
+		stats.addError("output")
+		return err
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, audio); err != nil {
+		// don't leave partially written files behind.
+		os.Remove(name)
+		stats.addError("output")
+		return fmt.Errorf("Could not write audio: %v", err)
+	}
+	infof("wrote audio to %s", name)
+	events.audioWritten(name)
+	return nil
+}
+
+// concatWriter appends each utterance to a file. That makes a valid file of
+// mp3, whose frames stand on their own, of raw pcm and of ogg, which can be
+// chained, but not of wav as each utterance has a header.
+type concatWriter struct {
+	file *os.File
+}
+
+// newConcatWriter creates the file at path to append the utterances of
+// format to.
+func newConcatWriter(path, format string) (concatWriter, error) {
+	if format == "wav" {
+		return concatWriter{}, fmt.Errorf("--concat-output can't join wav files, as each has a header")
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return concatWriter{}, echo.OutputError{Err: fmt.Errorf("Failed to create output file: %w", err)}
+	}
+	return concatWriter{file}, nil
+}
+
+// WriteSpeech implements echo.Writer.
+func (w concatWriter) WriteSpeech(text string, audio io.Reader) error {
+	if _, err := io.Copy(w.file, audio); err != nil {
+		stats.addError("output")
+		return fmt.Errorf("Could not write audio: %v", err)
+	}
+	debugf("appended '%s' to %s", text, w.file.Name())
+	events.audioWritten(w.file.Name())
+	return nil
+}
+
+// channelFiles writes utterances to files labelled with their channel.
+type channelFiles interface {
+	write(channel int, text string, audio io.Reader) error
+}
+
+// channelWriter writes the utterances of a channel with a fileWriter or an
+// s3Writer, labelling their files with the channel.
+type channelWriter struct {
+	w       channelFiles
+	channel int
+}
+
+// WriteSpeech implements echo.Writer.
+func (w channelWriter) WriteSpeech(text string, audio io.Reader) error {
+	return w.w.write(w.channel, text, audio)
+}
+
+// playWriter plays each utterance, logging when it can't.
+type playWriter struct {
+	format     string
+	sampleRate int
+	// guard, if set, is told when utterances are played.
+	guard *loopbackGuard
+
+	mu      sync.Mutex
+	playing *exec.Cmd
+}
+
+// WriteSpeech implements echo.Writer by piping the audio into sox's play
+// command, waiting for it to finish so that consecutive utterances don't
+// overlap.
+func (w *playWriter) WriteSpeech(text string, audio io.Reader) error {
+	cmd := playCommand(w.format, w.sampleRate)
+	cmd.Stdin = audio
+	w.guard.start()
+	defer w.guard.end()
+	w.mu.Lock()
+	err := cmd.Start()
+	if err == nil {
+		w.playing = cmd
+	}
+	w.mu.Unlock()
+	if err == nil {
+		err = cmd.Wait()
+		w.mu.Lock()
+		if w.playing != cmd {
+			// interrupted.
+			err = nil
+		}
+		w.playing = nil
+		w.mu.Unlock()
+	}
+	if err != nil {
+		stats.addError("output")
+		errorf("Could not play audio: %v", err)
+	}
+	return nil
+}
+
+// Interrupt implements echo.Interrupter by stopping the playback.
+func (w *playWriter) Interrupt() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.playing != nil {
+		infof("interrupted by new speech")
+		w.playing.Process.Kill()
+		w.playing = nil
+	}
+}
+
+// normalizeWriter normalizes the loudness of each utterance with sox before
+// writing it. sox has to read the whole utterance to know its loudness, so
+// nothing is written until it has been synthesized.
+type normalizeWriter struct {
+	echo.Writer
+	sox        string
+	format     string
+	sampleRate int
+}
+
+// WriteSpeech implements echo.Writer.
+func (w normalizeWriter) WriteSpeech(text string, audio io.Reader) error {
+	args := soxFormatArgs(w.format, w.sampleRate)
+	args = append(append(append(args, "-"), soxFormatArgs(w.format, w.sampleRate)...), "-", "gain", "-n", "-1")
+	cmd := exec.Command(w.sox, args...)
+	cmd.Stdin = audio
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Could not normalize audio: %v", err)
+	}
+	err = w.Writer.WriteSpeech(text, out)
+	// drain what's left in case the writer stopped early.
+	io.Copy(ioutil.Discard, out)
+	if werr := cmd.Wait(); err == nil && werr != nil {
+		err = fmt.Errorf("Could not normalize audio: %v", werr)
+	}
+	return err
+}
+
+// Interrupt implements echo.Interrupter if the underlying Writer does.
+func (w normalizeWriter) Interrupt() {
+	if i, ok := w.Writer.(echo.Interrupter); ok {
+		i.Interrupt()
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/slaskis/cloud-echo/echo"
+)
+
+func TestFileWriter(t *testing.T) {
+	dir := t.TempDir()
+	w := &fileWriter{dir: dir, ext: ".mp3", start: time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)}
+	for _, text := range []string{"hello", "world"} {
+		if err := w.WriteSpeech(text, strings.NewReader("audio of "+text)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.write(2, "again", strings.NewReader("audio of again")); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"20200304T050607-0001-hello.mp3":     "audio of hello",
+		"20200304T050607-0002-world.mp3":     "audio of world",
+		"20200304T050607-0003-ch2-again.mp3": "audio of again",
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(b) != want {
+			t.Errorf("%s = %q, want %q", name, b, want)
+		}
+	}
+}
+
+func TestFileWriterRemovesPartialFile(t *testing.T) {
+	dir := t.TempDir()
+	w := &fileWriter{dir: dir, ext: ".mp3", start: time.Now()}
+	audio := io.MultiReader(strings.NewReader("half"), iotest.ErrReader(errors.New("broken")))
+	if err := w.WriteSpeech("hello", audio); err == nil {
+		t.Fatal("wrote audio that couldn't be read")
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("left %s behind", files[0].Name())
+	}
+}
+
+func TestConcatWriter(t *testing.T) {
+	cases := []struct {
+		format string
+		err    bool
+	}{
+		{"mp3", false},
+		{"ogg_vorbis", false},
+		{"pcm", false},
+		{"wav", true},
+	}
+	for _, c := range cases {
+		t.Run(c.format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "session"+formatExtensions[c.format])
+			w, err := newConcatWriter(path, c.format)
+			if c.err {
+				if err == nil {
+					t.Fatalf("newConcatWriter(%s) succeeded, want an error", c.format)
+				}
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("created %s for a format it can't join", path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, text := range []string{"hello", "world"} {
+				if err := w.WriteSpeech(text, strings.NewReader(text+";")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			w.file.Close()
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(b), "hello;world;"; got != want {
+				t.Errorf("wrote %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestConcatWriterCreateError(t *testing.T) {
+	_, err := newConcatWriter(filepath.Join(t.TempDir(), "missing", "session.mp3"), "mp3")
+	var output echo.OutputError
+	if !errors.As(err, &output) {
+		t.Errorf("newConcatWriter() = %v, want an OutputError", err)
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	speech "cloud.google.com/go/speech/apiv1"
+	"github.com/golang/protobuf/ptypes"
+	gax "github.com/googleapis/gax-go"
+	"github.com/slaskis/cloud-echo/echo"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// minWatchInterval is how often a session is checked for a stall at most.
+const minWatchInterval = 10 * time.Millisecond
+
+// recentAudioSize is how many bytes of the most recently sent audio to
+// replay when a session ends unexpectedly, so that words spoken at the
+// boundary aren't lost.
+const recentAudioSize = 32 * 1024
+
+// streamer opens streaming recognition sessions, as a *speech.Client does.
+type streamer interface {
+	StreamingRecognize(ctx context.Context, opts ...gax.CallOption) (speechpb.Speech_StreamingRecognizeClient, error)
+}
+
+// GoogleRecognizer recognizes speech using the Google Cloud Speech
+// streaming API.
+//
+// A streaming session is limited in length by the API, so when a session
+// ends (or is older than maxSession) a new one is opened transparently. So
+// is a session that hasn't responded to the audio sent to it in
+// recvTimeout, as it may have stalled.
+type GoogleRecognizer struct {
+	ctx         context.Context
+	client      streamer
+	config      *speechpb.StreamingRecognitionConfig
+	maxSession  time.Duration
+	recvTimeout time.Duration
+
+	mu      sync.Mutex
+	stream  speechpb.Speech_StreamingRecognizeClient
+	cancel  context.CancelFunc
+	started time.Time
+	// waiting is when the first audio was sent that the session hasn't
+	// responded to since, or zero when there's none.
+	waiting time.Time
+	closed  bool
+	header  []byte
+	recent  []byte
+
+	results chan echo.Result
+	err     error
+}
+
+// NewGoogleRecognizer opens a streaming recognizer and sends the initial
+// configuration message. A maxSession of 0 only rotates sessions when the
+// API ends them, and a recvTimeout of 0 never considers them stalled.
+func NewGoogleRecognizer(ctx context.Context, client *speech.Client, config *speechpb.StreamingRecognitionConfig, maxSession, recvTimeout time.Duration) (*GoogleRecognizer, error) {
+	r, err := newGoogleRecognizer(ctx, client, config, maxSession, recvTimeout)
+	if err != nil {
+		return nil, err
+	}
+	go r.recv()
+	if recvTimeout > 0 {
+		go r.watch()
+	}
+	return r, nil
+}
+
+// newGoogleRecognizer opens the first session of a recognizer, without
+// receiving its results or watching it for stalls yet.
+func newGoogleRecognizer(ctx context.Context, client streamer, config *speechpb.StreamingRecognitionConfig, maxSession, recvTimeout time.Duration) (*GoogleRecognizer, error) {
+	r := &GoogleRecognizer{
+		ctx:         ctx,
+		client:      client,
+		config:      config,
+		maxSession:  maxSession,
+		recvTimeout: recvTimeout,
+		results:     make(chan echo.Result),
+	}
+	stream, cancel, err := r.open()
+	if err != nil {
+		return nil, err
+	}
+	r.stream = stream
+	r.cancel = cancel
+	r.started = clock.Now()
+	return r, nil
+}
+
+// open starts a new streaming session, which is aborted by cancel.
+func (r *GoogleRecognizer) open() (speechpb.Speech_StreamingRecognizeClient, context.CancelFunc, error) {
+	_, span := traces.Start(r.ctx, "google.StreamingRecognize")
+	defer span.End()
+	span.SetAttribute("language", r.config.Config.LanguageCode)
+	ctx, cancel := context.WithCancel(r.ctx)
+	stream, err := r.client.StreamingRecognize(ctx)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	// send the initial configuration message.
+	err = stream.Send(&speechpb.StreamingRecognizeRequest{
+		StreamingRequest: &speechpb.StreamingRecognizeRequest_StreamingConfig{
+			StreamingConfig: r.config,
+		},
+	})
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return stream, cancel, nil
+}
+
+// rotate replaces the current session with a new one and replays audio
+// to it. It must be called with mu held.
+func (r *GoogleRecognizer) rotate(replay ...[]byte) error {
+	infof("starting a new recognition session")
+	stream, cancel, err := r.open()
+	if err != nil {
+		return err
+	}
+	replayed := false
+	for _, audio := range replay {
+		if len(audio) == 0 {
+			continue
+		}
+		if err := send(stream, audio); err != nil {
+			return err
+		}
+		replayed = true
+	}
+	r.stream = stream
+	r.cancel = cancel
+	r.started = clock.Now()
+	r.waiting = time.Time{}
+	if replayed {
+		r.waiting = r.started
+	}
+	return nil
+}
+
+// replay returns the audio to replay to a new session after one ended
+// unexpectedly: the recent audio, after the header of a flac stream unless
+// it still starts with it. It must be called with mu held.
+func (r *GoogleRecognizer) replay() [][]byte {
+	if bytes.HasPrefix(r.recent, r.header) {
+		return [][]byte{r.recent}
+	}
+	return [][]byte{r.header, r.recent}
+}
+
+// watch reconnects when the session hasn't responded to audio in
+// recvTimeout, as Recv may otherwise wait forever on a connection that
+// silently dropped. While no audio is sent there's nothing to respond to,
+// so that's never a stall.
+func (r *GoogleRecognizer) watch() {
+	interval := r.recvTimeout / 4
+	if interval < minWatchInterval {
+		interval = minWatchInterval
+	}
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-r.ctx.Done():
+			return
+		}
+		if !r.checkStall() {
+			return
+		}
+	}
+}
+
+// checkStall reconnects if the session hasn't responded to audio in
+// recvTimeout. It reports false once the recognizer is closed.
+func (r *GoogleRecognizer) checkStall() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return false
+	}
+	if idle := clock.Now().Sub(r.waiting); !r.waiting.IsZero() && idle > r.recvTimeout {
+		warnf("no response from the recognizer in %v, reconnecting", idle.Round(time.Second))
+		cancel := r.cancel
+		if err := r.rotate(r.replay()...); err != nil {
+			warnf("Could not reconnect: %v", err)
+			// try again after another timeout.
+			r.waiting = clock.Now()
+		} else {
+			// abort the stalled session, recv moves on to the new one.
+			cancel()
+		}
+	}
+	return true
+}
+
+// SendAudio implements echo.Recognizer.
+func (r *GoogleRecognizer) SendAudio(audio []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSession > 0 && clock.Now().Sub(r.started) > r.maxSession {
+		// close the old session gracefully so that it still delivers the
+		// results for the audio it has received.
+		old := r.stream
+		if err := r.rotate(r.header); err != nil {
+			return err
+		}
+		if err := old.CloseSend(); err != nil {
+			return err
+		}
+	}
+
+	// keep the start of a flac stream as it contains its header, which a
+	// new session needs to decode the rest. Raw audio has no header, and
+	// replaying its start would be heard again.
+	if r.header == nil && r.config.Config.Encoding == speechpb.RecognitionConfig_FLAC {
+		r.header = append([]byte(nil), audio...)
+	}
+	if r.waiting.IsZero() {
+		r.waiting = clock.Now()
+	}
+	r.recent = append(r.recent, audio...)
+	if n := len(r.recent) - recentAudioSize; n > 0 {
+		r.recent = append(r.recent[:0], r.recent[n:]...)
+	}
+	return send(r.stream, audio)
+}
+
+// CloseSend implements echo.Recognizer.
+func (r *GoogleRecognizer) CloseSend() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return r.stream.CloseSend()
+}
+
+// Results implements echo.Recognizer.
+func (r *GoogleRecognizer) Results() <-chan echo.Result {
+	return r.results
+}
+
+// Err implements echo.Recognizer.
+func (r *GoogleRecognizer) Err() error {
+	return r.err
+}
+
+func (r *GoogleRecognizer) recv() {
+	defer close(r.results)
+
+	r.mu.Lock()
+	stream := r.stream
+	r.mu.Unlock()
+
+	for {
+		resp, err := stream.Recv()
+		r.mu.Lock()
+		current := r.stream
+		if stream == current {
+			r.waiting = time.Time{}
+		}
+		r.mu.Unlock()
+		if err != nil && err != io.EOF && stream != current {
+			// the session was aborted by a reconnect, move on to the new one.
+			stream = current
+			continue
+		}
+		if err == io.EOF {
+			r.mu.Lock()
+			next, closed := r.stream, r.closed
+			r.mu.Unlock()
+			if next != stream && !closed {
+				// the session was rotated, move on to the new one.
+				stream = next
+				continue
+			}
+			debugf("recv eof %v", resp)
+			return
+		}
+		if err == nil && resp.Error != nil {
+			err = status.ErrorProto(resp.Error)
+		}
+		if err != nil {
+			if !r.sessionEnded(err) {
+				stats.addError("recognize")
+				r.err = fmt.Errorf("Cannot stream results: %v", err)
+				return
+			}
+			r.mu.Lock()
+			if r.stream == stream && !r.closed {
+				err = r.rotate(r.replay()...)
+			}
+			stream = r.stream
+			r.mu.Unlock()
+			if err != nil {
+				r.err = fmt.Errorf("Could not reconnect: %v", err)
+				return
+			}
+			continue
+		}
+		for _, result := range resp.Results {
+			debugf("Result: %s", result)
+			alt := bestAlternative(result.Alternatives)
+			if alt == nil {
+				continue
+			}
+			res := echo.Result{
+				Transcript: alt.Transcript,
+				Confidence: alt.Confidence,
+				IsFinal:    result.IsFinal,
+				Timestamp:  clock.Now(),
+				Language:   r.config.Config.LanguageCode,
+			}
+			if result.IsFinal {
+				res.Words = words(alt.Words)
+			}
+			if len(result.Alternatives) > 1 {
+				for _, alt := range result.Alternatives {
+					res.Alternatives = append(res.Alternatives, echo.Alternative{Transcript: alt.Transcript, Confidence: alt.Confidence})
+				}
+			}
+			stats.addTranscript()
+			select {
+			case r.results <- res:
+			case <-r.ctx.Done():
+				r.err = r.ctx.Err()
+				return
+			}
+		}
+	}
+}
+
+// sessionEnded reports whether err means the API ended the session because
+// it reached its time limit.
+func (r *GoogleRecognizer) sessionEnded(err error) bool {
+	if r.ctx.Err() != nil {
+		return false
+	}
+	s, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+	return s.Code() == codes.OutOfRange || s.Code() == codes.DeadlineExceeded
+}
+
+// validateSampleRate checks that the API accepts audio of the given encoding
+// at rate hertz.
+func validateSampleRate(encoding speechpb.RecognitionConfig_AudioEncoding, rate int) error {
+	switch encoding {
+	case speechpb.RecognitionConfig_AMR:
+		if rate != 8000 {
+			return fmt.Errorf("Invalid sample rate %d for %s, it must be 8000", rate, encoding)
+		}
+	case speechpb.RecognitionConfig_AMR_WB:
+		if rate != 16000 {
+			return fmt.Errorf("Invalid sample rate %d for %s, it must be 16000", rate, encoding)
+		}
+	default:
+		if rate < 8000 || rate > 48000 {
+			return fmt.Errorf("Invalid sample rate %d for %s, it must be between 8000 and 48000", rate, encoding)
+		}
+	}
+	return nil
+}
+
+// bestAlternative returns the alternative with the highest confidence. The
+// API orders alternatives by confidence but it's only set on final results,
+// so ties keep the first one.
+func bestAlternative(alts []*speechpb.SpeechRecognitionAlternative) *speechpb.SpeechRecognitionAlternative {
+	var best *speechpb.SpeechRecognitionAlternative
+	for _, alt := range alts {
+		if best == nil || alt.Confidence > best.Confidence {
+			best = alt
+		}
+	}
+	return best
+}
+
+// words returns the words of an alternative with their times.
+func words(infos []*speechpb.WordInfo) []echo.Word {
+	var words []echo.Word
+	for _, info := range infos {
+		start, _ := ptypes.Duration(info.StartTime)
+		end, _ := ptypes.Duration(info.EndTime)
+		words = append(words, echo.Word{Word: info.Word, Start: start.Seconds(), End: end.Seconds()})
+	}
+	return words
+}
+
+func send(stream speechpb.Speech_StreamingRecognizeClient, audio []byte) error {
+	return stream.Send(&speechpb.StreamingRecognizeRequest{
+		StreamingRequest: &speechpb.StreamingRecognizeRequest_AudioContent{
+			AudioContent: audio,
+		},
+	})
+}
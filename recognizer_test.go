@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	gax "github.com/googleapis/gax-go"
+	"github.com/slaskis/cloud-echo/echo"
+	"github.com/slaskis/cloud-echo/echo/echotest"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+)
+
+// fakeStream keeps the audio sent to a streaming session, and responds
+// with its responses before it ends.
+type fakeStream struct {
+	speechpb.Speech_StreamingRecognizeClient
+	ctx       context.Context
+	sent      []string
+	closed    bool
+	responses []*speechpb.StreamingRecognizeResponse
+}
+
+func (s *fakeStream) Recv() (*speechpb.StreamingRecognizeResponse, error) {
+	if len(s.responses) == 0 {
+		return nil, io.EOF
+	}
+	resp := s.responses[0]
+	s.responses = s.responses[1:]
+	return resp, nil
+}
+
+func (s *fakeStream) Send(req *speechpb.StreamingRecognizeRequest) error {
+	if req.GetStreamingConfig() != nil {
+		s.sent = append(s.sent, "config")
+		return nil
+	}
+	s.sent = append(s.sent, string(req.GetAudioContent()))
+	return nil
+}
+
+func (s *fakeStream) CloseSend() error {
+	s.closed = true
+	return nil
+}
+
+// fakeClient opens fakeStreams.
+type fakeClient struct {
+	streams []*fakeStream
+}
+
+func (c *fakeClient) StreamingRecognize(ctx context.Context, opts ...gax.CallOption) (speechpb.Speech_StreamingRecognizeClient, error) {
+	s := &fakeStream{ctx: ctx}
+	c.streams = append(c.streams, s)
+	return s, nil
+}
+
+// sessions returns the audio sent to each session, after its config.
+func (c *fakeClient) sessions() [][]string {
+	var sessions [][]string
+	for _, s := range c.streams {
+		sessions = append(sessions, s.sent)
+	}
+	return sessions
+}
+
+func TestRecognizerHeader(t *testing.T) {
+	cases := []struct {
+		encoding speechpb.RecognitionConfig_AudioEncoding
+		header   string
+	}{
+		{speechpb.RecognitionConfig_FLAC, "fLaC"},
+		{speechpb.RecognitionConfig_LINEAR16, ""},
+		{speechpb.RecognitionConfig_MULAW, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.encoding.String(), func(t *testing.T) {
+			stream := &fakeStream{}
+			r := &GoogleRecognizer{
+				config: &speechpb.StreamingRecognitionConfig{
+					Config: &speechpb.RecognitionConfig{Encoding: c.encoding},
+				},
+				stream: stream,
+			}
+			for _, audio := range []string{"fLaC", "more"} {
+				if err := r.SendAudio([]byte(audio)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if string(r.header) != c.header {
+				t.Errorf("header = %q, want %q", r.header, c.header)
+			}
+			if got := string(r.recent); got != "fLaCmore" {
+				t.Errorf("recent audio = %q, want %q", got, "fLaCmore")
+			}
+			if len(stream.sent) != 2 {
+				t.Errorf("sent %q, want both chunks", stream.sent)
+			}
+			if r.waiting.IsZero() {
+				t.Errorf("not waiting for a response to the audio sent")
+			}
+		})
+	}
+}
+
+func TestRecognizerStall(t *testing.T) {
+	c := echotest.NewClock(time.Unix(0, 0))
+	useClock(t, c)
+	client := &fakeClient{}
+	config := &speechpb.StreamingRecognitionConfig{Config: &speechpb.RecognitionConfig{Encoding: speechpb.RecognitionConfig_LINEAR16}}
+	r, err := newGoogleRecognizer(context.Background(), client, config, 0, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(audio string) func() {
+		return func() {
+			if err := r.SendAudio([]byte(audio)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	steps := []struct {
+		name     string
+		step     func()
+		sessions int
+	}{
+		{"silence", func() { c.Advance(time.Hour) }, 1},
+		{"audio", send("a"), 1},
+		{"waiting for a response", func() { c.Advance(time.Second) }, 1},
+		{"stalled", func() { c.Advance(time.Millisecond) }, 2},
+		{"waiting for a response to the replay", func() { c.Advance(time.Second) }, 2},
+		{"stalled again", func() { c.Advance(time.Millisecond) }, 3},
+		{"more audio", send("b"), 3},
+	}
+	for _, s := range steps {
+		s.step()
+		if !r.checkStall() {
+			t.Fatalf("%s: the recognizer is closed", s.name)
+		}
+		if got := len(client.streams); got != s.sessions {
+			t.Errorf("%s: %d sessions, want %d", s.name, got, s.sessions)
+		}
+	}
+	want := [][]string{{"config", "a"}, {"config", "a"}, {"config", "a", "b"}}
+	if got := client.sessions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+	for i, s := range client.streams[:2] {
+		if s.ctx.Err() == nil {
+			t.Errorf("stalled session %d wasn't aborted", i+1)
+		}
+	}
+
+	if err := r.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(time.Hour)
+	if r.checkStall() {
+		t.Error("still watching a closed recognizer")
+	}
+}
+
+func TestRecognizerReplay(t *testing.T) {
+	flac := speechpb.RecognitionConfig_FLAC
+	linear16 := speechpb.RecognitionConfig_LINEAR16
+	long := strings.Repeat("x", recentAudioSize)
+	cases := []struct {
+		name     string
+		encoding speechpb.RecognitionConfig_AudioEncoding
+		audio    []string
+		replay   []string
+	}{
+		{"flac", flac, []string{"fLaC", "a"}, []string{"config", "fLaCa"}},
+		{"flac after the header was trimmed", flac, []string{"fLaC", "a", long}, []string{"config", "fLaC", long}},
+		{"linear16", linear16, []string{"ab", "c"}, []string{"config", "abc"}},
+		{"linear16 trimmed", linear16, []string{"ab", long}, []string{"config", long}},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			c := echotest.NewClock(time.Unix(0, 0))
+			useClock(t, c)
+			client := &fakeClient{}
+			config := &speechpb.StreamingRecognitionConfig{Config: &speechpb.RecognitionConfig{Encoding: tt.encoding}}
+			r, err := newGoogleRecognizer(context.Background(), client, config, 0, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, audio := range tt.audio {
+				if err := r.SendAudio([]byte(audio)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c.Advance(2 * time.Second)
+			r.checkStall()
+			if len(client.streams) != 2 {
+				t.Fatalf("%d sessions, want a reconnect", len(client.streams))
+			}
+			if got := client.streams[1].sent; !reflect.DeepEqual(got, tt.replay) {
+				t.Errorf("replayed %.20q, want %.20q", got, tt.replay)
+			}
+		})
+	}
+}
+
+func TestRecognizerMaxSession(t *testing.T) {
+	c := echotest.NewClock(time.Unix(0, 0))
+	useClock(t, c)
+	client := &fakeClient{}
+	config := &speechpb.StreamingRecognitionConfig{Config: &speechpb.RecognitionConfig{Encoding: speechpb.RecognitionConfig_LINEAR16}}
+	r, err := newGoogleRecognizer(context.Background(), client, config, time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []struct {
+		wait  time.Duration
+		audio string
+	}{
+		{0, "a"},
+		{time.Minute, "b"},
+		{time.Nanosecond, "c"},
+		{time.Minute, "d"},
+	} {
+		c.Advance(s.wait)
+		if err := r.SendAudio([]byte(s.audio)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := [][]string{{"config", "a", "b"}, {"config", "c", "d"}}
+	if got := client.sessions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+	if !client.streams[0].closed || client.streams[1].closed {
+		t.Error("only the old session should be closed")
+	}
+	if client.streams[0].ctx.Err() != nil {
+		t.Error("the old session was aborted before delivering its results")
+	}
+}
+
+func TestRecognizerWatch(t *testing.T) {
+	cases := []struct {
+		name    string
+		timeout time.Duration
+		tick    time.Duration
+	}{
+		{"shorter than a tick", time.Nanosecond, minWatchInterval},
+		{"longer than a tick", time.Second, time.Second / 4},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			clock := echotest.NewClock(time.Unix(0, 0))
+			useClock(t, clock)
+			ctx, cancel := context.WithCancel(context.Background())
+			r := &GoogleRecognizer{ctx: ctx, recvTimeout: c.timeout}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				r.watch()
+			}()
+			// without any audio sent no tick reconnects, which would need
+			// a client.
+			clock.Wait(1)
+			for i := 0; i < 10; i++ {
+				clock.Advance(c.tick)
+			}
+			cancel()
+			<-done
+		})
+	}
+}
+
+func alternative(transcript string, confidence float32) *speechpb.SpeechRecognitionAlternative {
+	return &speechpb.SpeechRecognitionAlternative{Transcript: transcript, Confidence: confidence}
+}
+
+func TestBestAlternative(t *testing.T) {
+	cases := []struct {
+		name string
+		alts []*speechpb.SpeechRecognitionAlternative
+		want string
+	}{
+		{"none", nil, ""},
+		{"one", []*speechpb.SpeechRecognitionAlternative{alternative("a", 0.5)}, "a"},
+		{"highest", []*speechpb.SpeechRecognitionAlternative{alternative("a", 0.5), alternative("b", 0.9), alternative("c", 0.7)}, "b"},
+		{"interim without confidence", []*speechpb.SpeechRecognitionAlternative{alternative("a", 0), alternative("b", 0)}, "a"},
+	}
+	for _, c := range cases {
+		got := bestAlternative(c.alts)
+		if got == nil && c.want != "" || got != nil && got.Transcript != c.want {
+			t.Errorf("%s: best alternative = %v, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestRecognizerResults(t *testing.T) {
+	stream := &fakeStream{responses: []*speechpb.StreamingRecognizeResponse{
+		{Results: []*speechpb.StreamingRecognitionResult{{
+			Alternatives: []*speechpb.SpeechRecognitionAlternative{alternative("hel", 0)},
+		}}},
+		{Results: []*speechpb.StreamingRecognitionResult{{
+			Alternatives: []*speechpb.SpeechRecognitionAlternative{alternative("hello", 0.6), alternative("yellow", 0.8)},
+			IsFinal:      true,
+		}}},
+		{Results: []*speechpb.StreamingRecognitionResult{{}}},
+	}}
+	r := &GoogleRecognizer{
+		ctx: context.Background(),
+		config: &speechpb.StreamingRecognitionConfig{
+			Config: &speechpb.RecognitionConfig{LanguageCode: "en-US"},
+		},
+		stream:  stream,
+		results: make(chan echo.Result),
+	}
+	go r.recv()
+	var got []echo.Result
+	for res := range r.Results() {
+		res.Timestamp = time.Time{}
+		got = append(got, res)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []echo.Result{
+		{Transcript: "hel", Language: "en-US"},
+		{Transcript: "yellow", Confidence: 0.8, IsFinal: true, Language: "en-US", Alternatives: []echo.Alternative{
+			{Transcript: "hello", Confidence: 0.6},
+			{Transcript: "yellow", Confidence: 0.8},
+		}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("results = %+v, want %+v", got, want)
+	}
+}
+
+func TestWords(t *testing.T) {
+	infos := []*speechpb.WordInfo{
+		{Word: "hello", StartTime: ptypes.DurationProto(1200 * time.Millisecond), EndTime: ptypes.DurationProto(1500 * time.Millisecond)},
+		{Word: "world", StartTime: ptypes.DurationProto(1500 * time.Millisecond), EndTime: ptypes.DurationProto(2 * time.Second)},
+	}
+	want := []echo.Word{{Word: "hello", Start: 1.2, End: 1.5}, {Word: "world", Start: 1.5, End: 2}}
+	if got := words(infos); !reflect.DeepEqual(got, want) {
+		t.Errorf("words = %+v, want %+v", got, want)
+	}
+	if got := words(nil); got != nil {
+		t.Errorf("words of none = %+v, want none", got)
+	}
+}
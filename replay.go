@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/slaskis/cloud-echo/echo"
+)
+
+// replayRecognizer "recognizes" the transcripts of a file written with
+// --transcript-file, so that they can be synthesized again.
+type replayRecognizer struct {
+	results chan echo.Result
+	err     error
+}
+
+// newReplayRecognizer emits a final result for each line of r, waiting
+// delay between them, until r ends or stopped is closed.
+func newReplayRecognizer(ctx context.Context, r io.Reader, delay time.Duration, stopped <-chan struct{}) *replayRecognizer {
+	rec := &replayRecognizer{results: make(chan echo.Result)}
+	go func() {
+		defer close(rec.results)
+		scanner := bufio.NewScanner(r)
+		for line := 1; scanner.Scan(); line++ {
+			res, ok := parseTranscript(scanner.Text())
+			if !ok {
+				warnf("Skipping line %d of the replay", line)
+				continue
+			}
+			if line > 1 && delay > 0 {
+				select {
+				case <-clock.After(delay):
+				case <-stopped:
+					return
+				case <-ctx.Done():
+					rec.err = ctx.Err()
+					return
+				}
+			}
+			select {
+			case rec.results <- res:
+			case <-stopped:
+				return
+			case <-ctx.Done():
+				rec.err = ctx.Err()
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			rec.err = fmt.Errorf("Could not read replay: %v", err)
+		}
+	}()
+	return rec
+}
+
+// parseTranscript parses a line written by writeTranscript. Lines without a
+// timestamp are replayed as is.
+func parseTranscript(line string) (echo.Result, bool) {
+	res := echo.Result{Confidence: 1, IsFinal: true, Timestamp: clock.Now()}
+	if i := strings.Index(line, "\t"); i >= 0 {
+		if ts, err := time.Parse(time.RFC3339, line[:i]); err == nil {
+			res.Timestamp = ts
+			line = line[i+1:]
+		}
+	}
+	res.Transcript = strings.TrimSpace(line)
+	return res, res.Transcript != ""
+}
+
+// SendAudio implements echo.Recognizer.
+func (r *replayRecognizer) SendAudio(audio []byte) error {
+	return nil
+}
+
+// CloseSend implements echo.Recognizer.
+func (r *replayRecognizer) CloseSend() error {
+	return nil
+}
+
+// Results implements echo.Recognizer.
+func (r *replayRecognizer) Results() <-chan echo.Result {
+	return r.results
+}
+
+// Err implements echo.Recognizer.
+func (r *replayRecognizer) Err() error {
+	return r.err
+}
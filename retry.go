@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/slaskis/cloud-echo/echo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// retrySynthesizer retries syntheses that fail with a temporary error,
+// doubling the delay between each attempt.
+type retrySynthesizer struct {
+	echo.Synthesizer
+	retries int
+	backoff time.Duration
+}
+
+// Synthesize implements echo.Synthesizer.
+func (s retrySynthesizer) Synthesize(ctx context.Context, text string) (io.ReadCloser, error) {
+	delay := s.backoff
+	for attempt := 0; ; attempt++ {
+		audio, err := s.Synthesizer.Synthesize(ctx, text)
+		if err == nil || attempt >= s.retries || !retryable(err) {
+			return audio, err
+		}
+		warnf("Could not synthesize, retrying in %s: %v", delay, err)
+		select {
+		case <-clock.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// retryStartup calls fn until it succeeds, retrying temporary errors up to
+// retries times with a doubling delay, so that a flaky connection when
+// starting doesn't end the echo. Errors such as invalid credentials aren't
+// retried.
+func retryStartup(ctx context.Context, what string, retries int, fn func() error) error {
+	delay := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= retries || !retryable(err) {
+			return err
+		}
+		warnf("Could not %s, retrying in %s: %v", what, delay, err)
+		select {
+		case <-clock.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// retryable reports whether err is worth retrying, such as when being
+// throttled or on server errors, as opposed to invalid requests.
+func retryable(err error) bool {
+	if request.IsErrorThrottle(err) || request.IsErrorRetryable(err) {
+		return true
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() >= 500
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+			return true
+		}
+	}
+	if tempErr, ok := err.(interface {
+		Temporary() bool
+	}); ok {
+		return tempErr.Temporary()
+	}
+	return false
+}
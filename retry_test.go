@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetryable(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"throttled", awserr.New("ThrottlingException", "slow down", nil), true},
+		{"server error", awserr.NewRequestFailure(awserr.New("Boom", "bad gateway", nil), 502, "id"), true},
+		{"invalid request", awserr.NewRequestFailure(awserr.New("InvalidSsmlException", "bad ssml", nil), 400, "id"), false},
+		{"unavailable", status.Error(codes.Unavailable, "try again"), true},
+		{"deadline exceeded", status.Error(codes.DeadlineExceeded, "too slow"), true},
+		{"invalid argument", status.Error(codes.InvalidArgument, "bad config"), false},
+		{"unauthenticated", status.Error(codes.Unauthenticated, "bad credentials"), false},
+		{"temporary", &net.DNSError{Err: "no answer", IsTemporary: true}, true},
+		{"not temporary", &net.DNSError{Err: "no such host"}, false},
+		{"other", errors.New("broken"), false},
+	}
+	for _, c := range cases {
+		if got := retryable(c.err); got != c.want {
+			t.Errorf("%s: retryable(%v) = %v, want %v", c.name, c.err, got, c.want)
+		}
+	}
+}
+
+// flakySynthesizer fails with the errors in turn before it succeeds.
+type flakySynthesizer struct {
+	errs     []error
+	attempts int
+}
+
+func (s *flakySynthesizer) Synthesize(ctx context.Context, text string) (io.ReadCloser, error) {
+	s.attempts++
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		return nil, err
+	}
+	return ioutil.NopCloser(strings.NewReader(text)), nil
+}
+
+func TestRetrySynthesizer(t *testing.T) {
+	temporary := status.Error(codes.Unavailable, "try again")
+	permanent := status.Error(codes.InvalidArgument, "bad request")
+	cases := []struct {
+		name     string
+		errs     []error
+		retries  int
+		attempts int
+		err      error
+	}{
+		{"succeeds", nil, 2, 1, nil},
+		{"retried", []error{temporary, temporary}, 2, 3, nil},
+		{"out of retries", []error{temporary, temporary, temporary}, 2, 3, temporary},
+		{"not retryable", []error{permanent}, 2, 1, permanent},
+		{"no retries", []error{temporary}, 0, 1, temporary},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			flaky := &flakySynthesizer{errs: c.errs}
+			s := retrySynthesizer{flaky, c.retries, time.Millisecond}
+			audio, err := s.Synthesize(context.Background(), "hello")
+			if err != c.err {
+				t.Fatalf("Synthesize() = %v, want %v", err, c.err)
+			}
+			if err == nil {
+				audio.Close()
+			}
+			if flaky.attempts != c.attempts {
+				t.Errorf("attempted %d times, want %d", flaky.attempts, c.attempts)
+			}
+		})
+	}
+}
+
+func TestRetrySynthesizerCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	flaky := &flakySynthesizer{errs: []error{status.Error(codes.Unavailable, "try again")}}
+	s := retrySynthesizer{flaky, 2, time.Hour}
+	if _, err := s.Synthesize(ctx, "hello"); err != context.Canceled {
+		t.Errorf("Synthesize() = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestRetryStartup(t *testing.T) {
+	temporary := status.Error(codes.Unavailable, "try again")
+	permanent := status.Error(codes.Unauthenticated, "bad credentials")
+	cases := []struct {
+		name     string
+		errs     []error
+		retries  int
+		attempts int
+		err      error
+	}{
+		{"succeeds", nil, 3, 1, nil},
+		{"retried", []error{temporary}, 3, 2, nil},
+		{"out of retries", []error{temporary}, 0, 1, temporary},
+		{"not retryable", []error{permanent, nil}, 3, 1, permanent},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			attempts := 0
+			err := retryStartup(context.Background(), "start", c.retries, func() error {
+				attempts++
+				if attempts > len(c.errs) {
+					return nil
+				}
+				return c.errs[attempts-1]
+			})
+			if err != c.err {
+				t.Fatalf("retryStartup() = %v, want %v", err, c.err)
+			}
+			if attempts != c.attempts {
+				t.Errorf("attempted %d times, want %d", attempts, c.attempts)
+			}
+		})
+	}
+}
+
+func TestRetryStartupCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := retryStartup(ctx, "start", 3, func() error {
+		return status.Error(codes.Unavailable, "try again")
+	})
+	if err != context.Canceled {
+		t.Errorf("retryStartup() = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// s3Timeout is how long an upload to s3 may take.
+const s3Timeout = 30 * time.Second
+
+// s3Writer uploads each utterance to an s3 bucket, named like the files of
+// a fileWriter. An upload that fails is logged, so that the echo goes on.
+type s3Writer struct {
+	signer      *v4.Signer
+	client      *http.Client
+	region      string
+	bucket      string
+	prefix      string
+	ext         string
+	contentType string
+	start       time.Time
+	seq         int
+}
+
+// newS3Writer creates a writer uploading to an s3 url, like
+// s3://bucket/prefix, in the region of sess.
+func newS3Writer(sess *session.Session, rawurl, format string) (*s3Writer, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("Invalid s3 url %s, it should be like s3://bucket/prefix", rawurl)
+	}
+	region := aws.StringValue(sess.Config.Region)
+	if region == "" {
+		return nil, fmt.Errorf("No aws region to upload to %s in, set --aws-region", rawurl)
+	}
+	return &s3Writer{
+		signer: v4.NewSigner(sess.Config.Credentials, func(s *v4.Signer) {
+			// s3 expects the path to be escaped only once.
+			s.DisableURIPathEscaping = true
+		}),
+		client:      &http.Client{Timeout: s3Timeout},
+		region:      region,
+		bucket:      u.Host,
+		prefix:      strings.Trim(u.Path, "/"),
+		ext:         formatExtensions[format],
+		contentType: contentTypes[format],
+		start:       clock.Now(),
+	}, nil
+}
+
+// WriteSpeech implements echo.Writer.
+func (w *s3Writer) WriteSpeech(text string, audio io.Reader) error {
+	return w.write(0, text, audio)
+}
+
+func (w *s3Writer) write(channel int, text string, audio io.Reader) error {
+	w.seq++
+	key := path.Join(w.prefix, fileName(w.start, w.seq, channel, text)+w.ext)
+	// the body is signed, so it's read in full first.
+	body, err := ioutil.ReadAll(audio)
+	if err != nil {
+		stats.addError("output")
+		return fmt.Errorf("Could not read audio: %v", err)
+	}
+	if err := w.put(key, body); err != nil {
+		stats.addError("output")
+		errorf("Could not upload audio to s3://%s/%s: %v", w.bucket, key, err)
+		return nil
+	}
+	infof("uploaded audio to s3://%s/%s", w.bucket, key)
+	events.audioWritten("s3://" + w.bucket + "/" + key)
+	return nil
+}
+
+func (w *s3Writer) put(key string, body []byte) error {
+	u := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", w.bucket, w.region, key)
+	req, err := http.NewRequest("PUT", u, nil)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", w.contentType)
+	if _, err := w.signer.Sign(req, bytes.NewReader(body), "s3", w.region, time.Now()); err != nil {
+		return err
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
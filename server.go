@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	speech "cloud.google.com/go/speech/apiv1"
+	"github.com/slaskis/cloud-echo/echo"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+)
+
+// contentTypes are the mime types of the output formats.
+var contentTypes = map[string]string{
+	"mp3":        "audio/mpeg",
+	"ogg_vorbis": "audio/ogg",
+	"pcm":        "application/octet-stream",
+	"wav":        "audio/wav",
+}
+
+// server echoes audio posted to /echo.
+type server struct {
+	mux *http.ServeMux
+	// newRecognizer starts recognizing the audio of a request in language.
+	newRecognizer func(ctx context.Context, language string) (echo.Recognizer, error)
+
+	synths     *synthesizers
+	translator echo.Translator
+	ssml       *ssmlTemplate
+}
+
+// newServer creates a server recognizing audio with client and speaking
+// with the synthesizer of the requested language, echoing it with the same
+// options as the command line.
+func newServer(client *speech.Client, encoding speechpb.RecognitionConfig_AudioEncoding, phrases []string, synths *synthesizers, translator echo.Translator, ssml *ssmlTemplate) *server {
+	s := &server{
+		mux: http.NewServeMux(),
+		newRecognizer: func(ctx context.Context, language string) (echo.Recognizer, error) {
+			return NewGoogleRecognizer(ctx, client, streamingConfig(language, encoding, phrases), opts.maxSession, opts.recvTimeout)
+		},
+		synths:     synths,
+		translator: translator,
+		ssml:       ssml,
+	}
+	s.mux.HandleFunc("/echo", s.handleEcho)
+	s.mux.HandleFunc("/ws", s.handleWebSocket)
+	return s
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// language returns the language requested by r, which must be --language
+// or one of --serve-languages, so that a client can't make the server set up
+// a synthesizer for any language it likes.
+func (s *server) language(r *http.Request) (string, error) {
+	language := r.URL.Query().Get("language")
+	if language == "" || language == opts.language {
+		return opts.language, nil
+	}
+	for _, l := range opts.serveLangs {
+		if l == language {
+			return language, nil
+		}
+	}
+	accepted := append([]string{opts.language}, opts.serveLangs...)
+	return "", fmt.Errorf("Unsupported language %s, the server accepts %s", language, strings.Join(accepted, ", "))
+}
+
+// synthOptions returns the settings of the syntheses requested by r with
+// the voice, format and text_type query parameters, which override those of
+// the command line.
+func (s *server) synthOptions(r *http.Request) (SynthOptions, error) {
+	q := r.URL.Query()
+	o := SynthOptions{
+		Voice:    q.Get("voice"),
+		Format:   q.Get("format"),
+		TextType: q.Get("text_type"),
+	}
+	if o.Voice == "" && o.Format == "" && o.TextType == "" {
+		return o, nil
+	}
+	if opts.ttsBackend == "espeak" {
+		return o, fmt.Errorf("espeak can't override voice, format or text_type")
+	}
+	if o.TextType != "" && o.TextType != "text" && o.TextType != "ssml" {
+		return o, fmt.Errorf("Invalid text_type %s, it must be text or ssml", o.TextType)
+	}
+	if o.Format != "" {
+		var err error
+		if opts.ttsBackend == "azure" {
+			_, err = azureOutputFormat(o.Format, opts.ttsRate)
+		} else {
+			_, err = pollySampleRate(o.Format, opts.ttsRate)
+		}
+		if err != nil {
+			return o, err
+		}
+	}
+	return o, nil
+}
+
+// handleEcho recognizes the audio in the request body, encoded as configured
+// by --codec and --sample-rate, and responds with the synthesized speech of
+// every final transcript. The language defaults to --language and can be
+// set to one of --serve-languages with the language query parameter, and
+// the voice, format and text_type query parameters override those of the
+// command line.
+func (s *server) handleEcho(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	language, err := s.language(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	synth, err := s.synths.get(language)
+	if err != nil {
+		errorf("Could not create synthesizer for %s: %v", language, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	o, err := s.synthOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := opts.outFormat
+	if o.Format != "" {
+		format = o.Format
+	}
+
+	ctx := withSynthOptions(r.Context(), o)
+	rec, err := s.newRecognizer(ctx, language)
+	if err != nil {
+		errorf("Could not create recognizer: %v", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	// the response isn't written until the whole request has been read,
+	// as the server may not read the body once the response has started.
+	var out bytes.Buffer
+	e := newEcho(rec, synth, s.synths, s.translator, s.ssml)
+	e.Writer = echo.WriterFunc(func(text string, audio io.Reader) error {
+		if _, err := io.Copy(&out, audio); err != nil {
+			return fmt.Errorf("Could not read audio: %v", err)
+		}
+		return nil
+	})
+	if err := e.Run(ctx, r.Body); err != nil {
+		var captureErr echo.CaptureError
+		var recognizeErr echo.RecognizeError
+		switch {
+		case errors.As(err, &captureErr):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.As(err, &recognizeErr):
+			errorf("%v", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		default:
+			errorf("%v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypes[format])
+	if _, err := out.WriteTo(w); err != nil {
+		errorf("Could not write audio: %v", err)
+	}
+}
+
+// handleWebSocket echoes the audio streamed over a websocket. The client
+// sends binary frames of audio, encoded as for /echo, and is sent the
+// synthesized speech of each final transcript as soon as it's available.
+// Closing the websocket ends the audio, after which the remaining speech is
+// sent before the server closes it too. It takes the same query parameters
+// as /echo.
+func (s *server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	language, err := s.language(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	synth, err := s.synths.get(language)
+	if err != nil {
+		errorf("Could not create synthesizer for %s: %v", language, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	o, err := s.synthOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		errorf("Could not upgrade to websocket: %v", err)
+		return
+	}
+	defer ws.Close()
+
+	// the request context isn't cancelled when a hijacked connection is
+	// closed, so the connection is tied to its own context.
+	ctx, cancel := context.WithCancel(withSynthOptions(context.Background(), o))
+	defer cancel()
+	rec, err := s.newRecognizer(ctx, language)
+	if err != nil {
+		errorf("Could not create recognizer: %v", err)
+		return
+	}
+	e := newEcho(rec, synth, s.synths, s.translator, s.ssml)
+	e.Writer = echo.WriterFunc(func(text string, audio io.Reader) error {
+		if _, err := io.Copy(ws, audio); err != nil {
+			return fmt.Errorf("Could not write audio: %v", err)
+		}
+		return nil
+	})
+	if err := e.Run(ctx, ws); err != nil {
+		errorf("websocket echo failed: %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/slaskis/cloud-echo/echo"
+	"github.com/slaskis/cloud-echo/echo/echotest"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+)
+
+// testServer is a server with fake recognizers, and a fake synthesizer for
+// en-US and sv-SE, the languages it accepts.
+type testServer struct {
+	*server
+	synths map[string]*echotest.Synthesizer
+
+	mu        sync.Mutex
+	languages []string
+}
+
+// newTestServer creates a testServer whose recognizers recognize results,
+// and then stop with err.
+func newTestServer(t *testing.T, err error, results ...echo.Result) *testServer {
+	setOpts(t, func(o *options) {
+		o.language = "en-US"
+		o.serveLangs = stringsFlag{"sv-SE"}
+		o.outFormat = "mp3"
+		o.ttsBackend = "polly"
+		o.ttsRate = 22050
+	})
+	s := &testServer{synths: map[string]*echotest.Synthesizer{
+		"en-US": {},
+		"sv-SE": {},
+	}}
+	synths := newSynthesizers("en-US", s.synths["en-US"])
+	synths.synths["sv-SE"] = s.synths["sv-SE"]
+	s.server = newServer(nil, speechpb.RecognitionConfig_LINEAR16, nil, synths, nil, nil)
+	s.newRecognizer = func(ctx context.Context, language string) (echo.Recognizer, error) {
+		s.mu.Lock()
+		s.languages = append(s.languages, language)
+		s.mu.Unlock()
+		rec := echotest.NewRecognizer(err, results...)
+		t.Cleanup(rec.Close)
+		return rec, nil
+	}
+	return s
+}
+
+// final is a final result of text.
+func final(text string) echo.Result {
+	return echo.Result{Transcript: text, IsFinal: true}
+}
+
+func TestHandleEcho(t *testing.T) {
+	results := []echo.Result{final("hello"), final("world")}
+	cases := []struct {
+		name      string
+		method    string
+		query     string
+		err       error
+		status    int
+		body      string
+		languages []string
+	}{
+		{"echo", "POST", "", nil, http.StatusOK, "helloworld", []string{"en-US"}},
+		{"language", "POST", "?language=sv-SE", nil, http.StatusOK, "helloworld", []string{"sv-SE"}},
+		{"default language", "POST", "?language=en-US", nil, http.StatusOK, "helloworld", []string{"en-US"}},
+		{"unsupported language", "POST", "?language=xx-XX", nil, http.StatusBadRequest, "Unsupported language xx-XX, the server accepts en-US, sv-SE\n", nil},
+		{"invalid format", "POST", "?format=flac", nil, http.StatusBadRequest, "Invalid output format flac, it must be one of mp3, ogg_vorbis, pcm, wav\n", nil},
+		{"invalid text_type", "POST", "?text_type=html", nil, http.StatusBadRequest, "Invalid text_type html, it must be text or ssml\n", nil},
+		{"not posted", "GET", "", nil, http.StatusMethodNotAllowed, "method not allowed\n", nil},
+		{"recognizer error", "POST", "", errors.New("broken"), http.StatusBadGateway, "", []string{"en-US"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestServer(t, c.err, results...)
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(c.method, "/echo"+c.query, strings.NewReader("audio")))
+			if w.Code != c.status {
+				t.Errorf("status %d, want %d: %s", w.Code, c.status, w.Body.String())
+			}
+			if c.body != "" && w.Body.String() != c.body {
+				t.Errorf("responded %q, want %q", w.Body.String(), c.body)
+			}
+			if c.status == http.StatusOK {
+				if ct := w.Header().Get("Content-Type"); ct != "audio/mpeg" {
+					t.Errorf("Content-Type %q, want audio/mpeg", ct)
+				}
+				language := c.languages[0]
+				if got := s.synths[language].Texts(); !reflect.DeepEqual(got, []string{"hello", "world"}) {
+					t.Errorf("synthesized %q in %s, want hello and world", got, language)
+				}
+			}
+			if !reflect.DeepEqual(s.languages, c.languages) {
+				t.Errorf("recognized in %q, want %q", s.languages, c.languages)
+			}
+			if c.status == http.StatusBadRequest {
+				for language, synth := range s.synths {
+					if got := synth.Texts(); len(got) != 0 {
+						t.Errorf("synthesized %q in %s", got, language)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSynthOptions(t *testing.T) {
+	cases := []struct {
+		name    string
+		backend string
+		rate    int
+		query   string
+		want    SynthOptions
+		err     string
+	}{
+		{"no overrides", "polly", 22050, "", SynthOptions{}, ""},
+		{"polly", "polly", 16000, "?voice=Astrid&format=pcm&text_type=ssml", SynthOptions{Voice: "Astrid", Format: "pcm", TextType: "ssml"}, ""},
+		{"azure", "azure", 48000, "?voice=sv-SE-SofieNeural&format=wav&text_type=text", SynthOptions{Voice: "sv-SE-SofieNeural", Format: "wav", TextType: "text"}, ""},
+		{"espeak without overrides", "espeak", 22050, "", SynthOptions{}, ""},
+		{"espeak", "espeak", 22050, "?voice=sv", SynthOptions{}, "espeak can't override voice, format or text_type"},
+		{"invalid text_type", "polly", 22050, "?text_type=html", SynthOptions{}, "Invalid text_type html, it must be text or ssml"},
+		{"invalid polly format", "polly", 22050, "?format=flac", SynthOptions{}, "Invalid output format flac, it must be one of mp3, ogg_vorbis, pcm, wav"},
+		{"invalid polly rate", "polly", 22050, "?format=pcm", SynthOptions{}, "Invalid sample rate 22050 for pcm from polly, it must be one of 8000, 16000"},
+		{"invalid azure format", "azure", 16000, "?format=ogg_vorbis", SynthOptions{}, "Invalid output format ogg_vorbis for azure, it must be mp3, pcm or wav"},
+		{"invalid azure rate", "azure", 8000, "?format=mp3", SynthOptions{}, "Invalid sample rate 8000 for mp3 with azure, it must be one of 16000, 24000, 48000"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setOpts(t, func(o *options) {
+				o.ttsBackend = c.backend
+				o.ttsRate = c.rate
+			})
+			s := &server{}
+			o, err := s.synthOptions(httptest.NewRequest("POST", "/echo"+c.query, nil))
+			if c.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), c.err) {
+					t.Fatalf("got %v, want %s", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(o, c.want) {
+				t.Errorf("got %+v, want %+v", o, c.want)
+			}
+		})
+	}
+}
+
+// dialWebSocket opens a websocket to url of srv.
+func dialWebSocket(t *testing.T, srv *httptest.Server, url string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	io.WriteString(conn, "GET "+url+" HTTP/1.1\r\nHost: echo\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, r, resp
+}
+
+// writeClientFrame sends a masked frame, as a client does.
+func writeClientFrame(t *testing.T, w io.Writer, op byte, payload []byte) {
+	mask := []byte{1, 2, 3, 4}
+	frame := append([]byte{0x80 | op, 0x80 | byte(len(payload))}, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := w.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readServerFrames reads the payloads of the binary frames the server sends
+// until it closes the websocket.
+func readServerFrames(t *testing.T, r *bufio.Reader) []string {
+	var payloads []string
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			t.Fatalf("the websocket ended without being closed: %v", err)
+		}
+		payload := make([]byte, head[1]&0x7f)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			t.Fatal(err)
+		}
+		if head[0]&0x0f == opClose {
+			return payloads
+		}
+		payloads = append(payloads, string(payload))
+	}
+}
+
+func TestHandleWebSocket(t *testing.T) {
+	s := newTestServer(t, nil, final("hello"), final("world"))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	conn, r, resp := dialWebSocket(t, srv, "/ws?language=sv-SE")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %s, want a websocket", resp.Status)
+	}
+	writeClientFrame(t, conn, opBinary, []byte("audio"))
+	writeClientFrame(t, conn, opClose, nil)
+	if got, want := readServerFrames(t, r), []string{"hello", "world"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+	if got := s.synths["sv-SE"].Texts(); !reflect.DeepEqual(got, []string{"hello", "world"}) {
+		t.Errorf("synthesized %q in sv-SE, want hello and world", got)
+	}
+}
+
+func TestHandleWebSocketBadRequest(t *testing.T) {
+	cases := []struct {
+		name  string
+		query string
+		err   string
+	}{
+		{"unsupported language", "?language=xx-XX", "Unsupported language xx-XX"},
+		{"invalid format", "?format=flac", "Invalid output format flac"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestServer(t, nil, final("hello"))
+			srv := httptest.NewServer(s)
+			defer srv.Close()
+
+			_, _, resp := dialWebSocket(t, srv, "/ws"+c.query)
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), c.err) {
+				t.Errorf("responded %s: %s, want %s", resp.Status, body, c.err)
+			}
+			if len(s.languages) != 0 {
+				t.Errorf("recognized in %q", s.languages)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// isSSML reports whether text is an SSML document.
+func isSSML(text string) bool {
+	return strings.HasPrefix(strings.TrimSpace(text), "<speak")
+}
+
+// escapeSSML escapes the XML special characters in text so that it can be
+// embedded in an SSML document.
+func escapeSSML(text string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(text))
+	return buf.String()
+}
+
+// plainSSMLTemplate only escapes the transcript in an SSML document.
+const plainSSMLTemplate = "<speak>{{.}}</speak>"
+
+// ssmlTemplate wraps transcripts in an SSML document, given as a template
+// where {{.}} is the escaped transcript.
+type ssmlTemplate struct {
+	tmpl *template.Template
+}
+
+func parseSSMLTemplate(text string) (*ssmlTemplate, error) {
+	tmpl, err := template.New("ssml").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &ssmlTemplate{tmpl}, nil
+}
+
+// Wrap returns the SSML document for the transcript text.
+func (t *ssmlTemplate) Wrap(text string) (string, error) {
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, escapeSSML(text)); err != nil {
+		return "", err
+	}
+	ssml := buf.String()
+	if !isSSML(ssml) {
+		ssml = "<speak>" + ssml + "</speak>"
+	}
+	return ssml, nil
+}
+
+var (
+	rateKeywords   = []string{"x-slow", "slow", "medium", "fast", "x-fast"}
+	pitchKeywords  = []string{"default", "x-low", "low", "medium", "high", "x-high"}
+	volumeKeywords = []string{"default", "silent", "x-soft", "soft", "medium", "loud", "x-loud"}
+)
+
+// prosodyTemplate returns an ssml template setting the rate, pitch and
+// volume of the speech, with the values and ranges accepted by Polly. Empty
+// values are left out.
+func prosodyTemplate(rate, pitch, volume string) (string, error) {
+	var attrs []string
+	if rate != "" {
+		if !validProsody(rate, rateKeywords, "%", 20, 200, false) {
+			return "", fmt.Errorf("Invalid rate %s, it must be one of %s or a percentage between 20%% and 200%%", rate, strings.Join(rateKeywords, ", "))
+		}
+		attrs = append(attrs, fmt.Sprintf("rate=%q", rate))
+	}
+	if pitch != "" {
+		if !validProsody(pitch, pitchKeywords, "%", -33.3, 50, true) {
+			return "", fmt.Errorf("Invalid pitch %s, it must be one of %s or a relative percentage between -33.3%% and +50%%", pitch, strings.Join(pitchKeywords, ", "))
+		}
+		attrs = append(attrs, fmt.Sprintf("pitch=%q", pitch))
+	}
+	if volume != "" {
+		if !validProsody(volume, volumeKeywords, "dB", math.Inf(-1), 6, true) {
+			return "", fmt.Errorf("Invalid volume %s, it must be one of %s or relative decibels up to +6dB", volume, strings.Join(volumeKeywords, ", "))
+		}
+		attrs = append(attrs, fmt.Sprintf("volume=%q", volume))
+	}
+	return "<speak><prosody " + strings.Join(attrs, " ") + ">{{.}}</prosody></speak>", nil
+}
+
+// validProsody reports whether value is one of the keywords or a number
+// with the unit between min and max. Relative numbers must have a sign.
+func validProsody(value string, keywords []string, unit string, min, max float64, relative bool) bool {
+	for _, k := range keywords {
+		if value == k {
+			return true
+		}
+	}
+	if !strings.HasSuffix(value, unit) {
+		return false
+	}
+	number := strings.TrimSuffix(value, unit)
+	signed := strings.HasPrefix(number, "+") || strings.HasPrefix(number, "-")
+	if signed != relative {
+		return false
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	return err == nil && n >= min && n <= max
+}
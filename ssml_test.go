@@ -0,0 +1,77 @@
+package main
+
+import "testing"
+
+func TestSSMLTemplate(t *testing.T) {
+	cases := []struct {
+		tmpl string
+		text string
+		want string
+	}{
+		{plainSSMLTemplate, "hello", "<speak>hello</speak>"},
+		{plainSSMLTemplate, "rock & roll <3", "<speak>rock &amp; roll &lt;3</speak>"},
+		{plainSSMLTemplate, `"it's"`, "<speak>&#34;it&#39;s&#34;</speak>"},
+		{`<prosody rate="slow">{{.}}</prosody>`, "a<b", `<speak><prosody rate="slow">a&lt;b</prosody></speak>`},
+		{`<speak><break time="1s"/>{{.}}</speak>`, "hi", `<speak><break time="1s"/>hi</speak>`},
+	}
+	for _, c := range cases {
+		tmpl, err := parseSSMLTemplate(c.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := tmpl.Wrap(c.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("%s wrapped %q as %q, want %q", c.tmpl, c.text, got, c.want)
+		}
+	}
+}
+
+func TestProsodyTemplate(t *testing.T) {
+	cases := []struct {
+		rate, pitch, volume string
+		want                string
+	}{
+		{"slow", "", "", `<speak><prosody rate="slow">{{.}}</prosody></speak>`},
+		{"80%", "", "", `<speak><prosody rate="80%">{{.}}</prosody></speak>`},
+		{"20%", "", "", `<speak><prosody rate="20%">{{.}}</prosody></speak>`},
+		{"200%", "", "", `<speak><prosody rate="200%">{{.}}</prosody></speak>`},
+		{"+80%", "", "", ""},
+		{"-80%", "", "", ""},
+		{"19%", "", "", ""},
+		{"201%", "", "", ""},
+		{"80", "", "", ""},
+		{"quick", "", "", ""},
+		{"", "high", "", `<speak><prosody pitch="high">{{.}}</prosody></speak>`},
+		{"", "+50%", "", `<speak><prosody pitch="+50%">{{.}}</prosody></speak>`},
+		{"", "-33.3%", "", `<speak><prosody pitch="-33.3%">{{.}}</prosody></speak>`},
+		{"", "50%", "", ""},
+		{"", "+51%", "", ""},
+		{"", "-34%", "", ""},
+		{"", "", "loud", `<speak><prosody volume="loud">{{.}}</prosody></speak>`},
+		{"", "", "+6dB", `<speak><prosody volume="+6dB">{{.}}</prosody></speak>`},
+		{"", "", "-20dB", `<speak><prosody volume="-20dB">{{.}}</prosody></speak>`},
+		{"", "", "6dB", ""},
+		{"", "", "+7dB", ""},
+		{"", "", "+6%", ""},
+		{"fast", "low", "soft", `<speak><prosody rate="fast" pitch="low" volume="soft">{{.}}</prosody></speak>`},
+	}
+	for _, c := range cases {
+		got, err := prosodyTemplate(c.rate, c.pitch, c.volume)
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("prosodyTemplate(%q, %q, %q) = %s, want an error", c.rate, c.pitch, c.volume, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("prosodyTemplate(%q, %q, %q): %v", c.rate, c.pitch, c.volume, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("prosodyTemplate(%q, %q, %q) = %s, want %s", c.rate, c.pitch, c.volume, got, c.want)
+		}
+	}
+}
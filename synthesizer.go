@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/polly"
+)
+
+// outputFormats are the audio formats polly can synthesize and the sample
+// rates it supports for each of them. pcm is raw signed 16-bit little endian
+// mono samples, without any container or header, and wav is pcm with one.
+var outputFormats = map[string][]int{
+	"mp3":        {8000, 16000, 22050, 24000},
+	"ogg_vorbis": {8000, 16000, 22050, 24000},
+	"pcm":        {8000, 16000},
+	"wav":        {8000, 16000},
+}
+
+// formatExtensions are the file extensions of the output formats.
+var formatExtensions = map[string]string{
+	"mp3":        ".mp3",
+	"ogg_vorbis": ".ogg",
+	"pcm":        ".pcm",
+	"wav":        ".wav",
+}
+
+// nopSynthesizer synthesizes silence, for dry runs.
+type nopSynthesizer struct{}
+
+// Synthesize implements echo.Synthesizer.
+func (nopSynthesizer) Synthesize(ctx context.Context, text string) (io.ReadCloser, error) {
+	infof("would say '%s'", text)
+	return ioutil.NopCloser(strings.NewReader("")), nil
+}
+
+// SynthOptions are the settings of a synthesis.
+type SynthOptions struct {
+	// Voice is the id of the voice to speak with.
+	Voice string
+	// Format is the output format, one of outputFormats.
+	Format string
+	// SampleRate is the sample rate of the audio in hertz.
+	SampleRate int
+	// TextType is "text" or "ssml". When empty only text that starts with
+	// a <speak> tag is synthesized as SSML.
+	TextType string
+	// Lexicons are the names of the pronunciation lexicons to apply.
+	Lexicons []string
+}
+
+// merge returns o with its empty settings taken from defaults.
+func (o SynthOptions) merge(defaults SynthOptions) SynthOptions {
+	if o.Voice == "" {
+		o.Voice = defaults.Voice
+	}
+	if o.Format == "" {
+		o.Format = defaults.Format
+	}
+	if o.SampleRate == 0 {
+		o.SampleRate = defaults.SampleRate
+	}
+	if o.TextType == "" {
+		o.TextType = defaults.TextType
+	}
+	if o.Lexicons == nil {
+		o.Lexicons = defaults.Lexicons
+	}
+	return o
+}
+
+type synthOptionsKey struct{}
+
+// withSynthOptions returns a context overriding the settings of the
+// syntheses made with it, such as those of a single server request. Only
+// the non-empty settings of o are overridden.
+func withSynthOptions(ctx context.Context, o SynthOptions) context.Context {
+	return context.WithValue(ctx, synthOptionsKey{}, o)
+}
+
+// synthOptions returns the settings that ctx overrides.
+func synthOptions(ctx context.Context) SynthOptions {
+	o, _ := ctx.Value(synthOptionsKey{}).(SynthOptions)
+	return o
+}
+
+// PollySynthesizer synthesizes speech using AWS Polly.
+type PollySynthesizer struct {
+	svc      *polly.Polly
+	defaults SynthOptions
+}
+
+// NewPollySynthesizer creates a Synthesizer speaking with the defaults,
+// which may be overridden per synthesis with withSynthOptions.
+func NewPollySynthesizer(sess *session.Session, defaults SynthOptions) (*PollySynthesizer, error) {
+	if _, err := pollySampleRate(defaults.Format, defaults.SampleRate); err != nil {
+		return nil, err
+	}
+	return &PollySynthesizer{
+		svc:      polly.New(sess),
+		defaults: defaults,
+	}, nil
+}
+
+// Synthesize implements echo.Synthesizer.
+//
+// When Polly rejects expired credentials they are refreshed once before
+// trying again. Only credentials that can be renewed, such as the roles of
+// EC2 instances or ECS tasks and roles assumed through a profile, will work
+// again after a refresh. Keys from the environment or the shared credentials
+// file can't be renewed.
+func (p *PollySynthesizer) Synthesize(ctx context.Context, text string) (io.ReadCloser, error) {
+	o := synthOptions(ctx).merge(p.defaults)
+	if o.TextType == "" {
+		o.TextType = "text"
+		if isSSML(text) {
+			o.TextType = "ssml"
+		}
+	}
+	_, span := traces.Start(ctx, "polly.SynthesizeSpeech")
+	defer span.End()
+	span.SetAttribute("voice", o.Voice)
+	span.SetAttribute("text.length", len(text))
+	audio, err := say(ctx, p.svc, o, text)
+	if isExpired(err) {
+		warnf("AWS credentials expired, refreshing them: %v", err)
+		p.svc.Config.Credentials.Expire()
+		audio, err = say(ctx, p.svc, o, text)
+	}
+	return audio, err
+}
+
+// isExpired reports whether err means the credentials have expired.
+func isExpired(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "ExpiredToken", "ExpiredTokenException", "RequestExpired":
+			return true
+		}
+	}
+	return false
+}
+
+// validateOutputFormat checks that polly can synthesize format.
+func validateOutputFormat(format string) error {
+	if _, ok := outputFormats[format]; ok {
+		return nil
+	}
+	valid := make([]string, 0, len(outputFormats))
+	for f := range outputFormats {
+		valid = append(valid, f)
+	}
+	sort.Strings(valid)
+	return fmt.Errorf("Invalid output format %s, it must be one of %s", format, strings.Join(valid, ", "))
+}
+
+// ttsSampleRate returns the sample rate to synthesize format at with the
+// tts backend, closest to rate without going over it if the backend can't
+// synthesize rate itself.
+func ttsSampleRate(backend, format string, rate int) int {
+	var rates []int
+	switch backend {
+	case "polly":
+		rates = outputFormats[format]
+	case "azure":
+		for r := range azureOutputFormats[format] {
+			rates = append(rates, r)
+		}
+		sort.Ints(rates)
+	}
+	if len(rates) == 0 {
+		return rate
+	}
+	best := rates[0]
+	for _, r := range rates {
+		if r == rate {
+			return rate
+		}
+		if r < rate {
+			best = r
+		}
+	}
+	return best
+}
+
+// pollySampleRate formats rate the way polly expects it for format.
+func pollySampleRate(format string, rate int) (string, error) {
+	if err := validateOutputFormat(format); err != nil {
+		return "", err
+	}
+	rates := outputFormats[format]
+	for _, r := range rates {
+		if r == rate {
+			return strconv.Itoa(rate), nil
+		}
+	}
+	valid := make([]string, len(rates))
+	for i, r := range rates {
+		valid[i] = strconv.Itoa(r)
+	}
+	return "", fmt.Errorf("Invalid sample rate %d for %s from polly, it must be one of %s", rate, format, strings.Join(valid, ", "))
+}
+
+func say(ctx context.Context, svc *polly.Polly, o SynthOptions, text string) (io.ReadCloser, error) {
+	infof("saying '%s'", text)
+	input, err := speechInput(o, text)
+	if err != nil {
+		return nil, err
+	}
+	result, err := svc.SynthesizeSpeechWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if o.Format == "wav" {
+		return wrapWAV(result.AudioStream, o.SampleRate)
+	}
+	return result.AudioStream, nil
+}
+
+// speechInput returns the polly request synthesizing text with o. Polly's
+// engine can't be chosen, as the vendored SDK predates neural voices.
+func speechInput(o SynthOptions, text string) (*polly.SynthesizeSpeechInput, error) {
+	rate, err := pollySampleRate(o.Format, o.SampleRate)
+	if err != nil {
+		return nil, err
+	}
+	format := o.Format
+	if format == "wav" {
+		// polly can't write wav, say wraps the pcm in a header instead.
+		format = "pcm"
+	}
+	input := &polly.SynthesizeSpeechInput{
+		OutputFormat: aws.String(format),
+		SampleRate:   aws.String(rate),
+		Text:         aws.String(text),
+		TextType:     aws.String(o.TextType),
+		VoiceId:      aws.String(o.Voice),
+	}
+	if len(o.Lexicons) > 0 {
+		input.LexiconNames = aws.StringSlice(o.Lexicons)
+	}
+	return input, nil
+}
+
+// checkLexicons checks that polly has the lexicons with the given names.
+func checkLexicons(svc *polly.Polly, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	var available []string
+	input := &polly.ListLexiconsInput{}
+	for {
+		out, err := svc.ListLexicons(input)
+		if err != nil {
+			return fmt.Errorf("Failed to list lexicons: %v", err)
+		}
+		for _, l := range out.Lexicons {
+			available = append(available, aws.StringValue(l.Name))
+		}
+		if out.NextToken == nil {
+			break
+		}
+		input.NextToken = out.NextToken
+	}
+	for _, name := range names {
+		if !contains(available, name) {
+			return fmt.Errorf("Unknown lexicon %s, available lexicons: %s", name, strings.Join(available, ", "))
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/polly"
+)
+
+func TestPollySampleRate(t *testing.T) {
+	cases := []struct {
+		format string
+		rate   int
+		want   string
+	}{
+		{"mp3", 22050, "22050"},
+		{"mp3", 8000, "8000"},
+		{"ogg_vorbis", 24000, "24000"},
+		{"pcm", 16000, "16000"},
+		{"pcm", 22050, ""},
+		{"wav", 8000, "8000"},
+		{"mp3", 44100, ""},
+		{"flac", 16000, ""},
+	}
+	for _, c := range cases {
+		got, err := pollySampleRate(c.format, c.rate)
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("pollySampleRate(%s, %d) = %s, want an error", c.format, c.rate, got)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("pollySampleRate(%s, %d) = %s, %v, want %s", c.format, c.rate, got, err, c.want)
+		}
+	}
+}
+
+// countingProvider provides static credentials, counting how often they're
+// retrieved.
+type countingProvider struct {
+	retrieved int
+	expired   bool
+}
+
+func (p *countingProvider) Retrieve() (credentials.Value, error) {
+	p.retrieved++
+	p.expired = false
+	return credentials.Value{AccessKeyID: "key", SecretAccessKey: "secret"}, nil
+}
+
+func (p *countingProvider) IsExpired() bool { return p.expired }
+
+// fakePolly starts a server answering polly's requests with handler, and
+// returns a session using it.
+func fakePolly(t *testing.T, provider credentials.Provider, handler http.HandlerFunc) *session.Session {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:    aws.String(srv.URL),
+		Region:      aws.String("eu-west-1"),
+		Credentials: credentials.NewCredentials(provider),
+		MaxRetries:  aws.Int(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sess
+}
+
+func TestTTSSampleRate(t *testing.T) {
+	cases := []struct {
+		backend string
+		format  string
+		rate    int
+		want    int
+	}{
+		{"polly", "mp3", 22050, 22050},
+		{"polly", "mp3", 44100, 24000},
+		{"polly", "pcm", 16000, 16000},
+		{"polly", "pcm", 48000, 16000},
+		{"polly", "wav", 11025, 8000},
+		{"azure", "mp3", 48000, 48000},
+		{"azure", "mp3", 44100, 24000},
+		// nothing is below it, so the lowest rate goes over it.
+		{"azure", "mp3", 8000, 16000},
+		{"azure", "pcm", 22050, 16000},
+		{"azure", "ogg_vorbis", 16000, 16000},
+		{"espeak", "wav", 22050, 22050},
+	}
+	for _, c := range cases {
+		if got := ttsSampleRate(c.backend, c.format, c.rate); got != c.want {
+			t.Errorf("ttsSampleRate(%s, %s, %d) = %d, want %d", c.backend, c.format, c.rate, got, c.want)
+		}
+	}
+}
+
+func TestPollySynthesizerExpiredCredentials(t *testing.T) {
+	cases := []struct {
+		name      string
+		failures  int
+		code      string
+		retrieved int
+		err       bool
+	}{
+		{"valid", 0, "", 1, false},
+		{"expired once", 1, "ExpiredTokenException", 2, false},
+		{"still expired", 2, "ExpiredTokenException", 2, true},
+		{"other error", 1, "ValidationException", 1, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			provider := &countingProvider{}
+			requests := 0
+			sess := fakePolly(t, provider, func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if requests <= c.failures {
+					w.Header().Set("X-Amzn-Errortype", c.code)
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprintf(w, `{"message":"%s"}`, c.code)
+					return
+				}
+				w.Header().Set("Content-Type", "audio/mpeg")
+				io.WriteString(w, "speech")
+			})
+			s, err := NewPollySynthesizer(sess, SynthOptions{Voice: "Astrid", Format: "mp3", SampleRate: 22050})
+			if err != nil {
+				t.Fatal(err)
+			}
+			audio, err := s.Synthesize(context.Background(), "hello")
+			if (err != nil) != c.err {
+				t.Fatalf("Synthesize() error = %v, want error %v", err, c.err)
+			}
+			if err == nil {
+				b, _ := ioutil.ReadAll(audio)
+				audio.Close()
+				if string(b) != "speech" {
+					t.Errorf("synthesized %q, want %q", b, "speech")
+				}
+			}
+			if provider.retrieved != c.retrieved {
+				t.Errorf("retrieved the credentials %d times, want %d", provider.retrieved, c.retrieved)
+			}
+		})
+	}
+}
+
+func TestSpeechInput(t *testing.T) {
+	cases := []struct {
+		name string
+		o    SynthOptions
+		want polly.SynthesizeSpeechInput
+	}{
+		{
+			name: "mp3",
+			o:    SynthOptions{Voice: "Astrid", Format: "mp3", SampleRate: 22050, TextType: "text"},
+			want: polly.SynthesizeSpeechInput{
+				OutputFormat: aws.String("mp3"),
+				SampleRate:   aws.String("22050"),
+				Text:         aws.String("hello"),
+				TextType:     aws.String("text"),
+				VoiceId:      aws.String("Astrid"),
+			},
+		},
+		{
+			name: "wav is synthesized as pcm",
+			o:    SynthOptions{Voice: "Astrid", Format: "wav", SampleRate: 16000, TextType: "ssml", Lexicons: []string{"names"}},
+			want: polly.SynthesizeSpeechInput{
+				LexiconNames: aws.StringSlice([]string{"names"}),
+				OutputFormat: aws.String("pcm"),
+				SampleRate:   aws.String("16000"),
+				Text:         aws.String("hello"),
+				TextType:     aws.String("ssml"),
+				VoiceId:      aws.String("Astrid"),
+			},
+		},
+	}
+	for _, c := range cases {
+		got, err := speechInput(c.o, "hello")
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, c.want) {
+			t.Errorf("%s: input = %s, want %s", c.name, got, &c.want)
+		}
+	}
+	if _, err := speechInput(SynthOptions{Format: "pcm", SampleRate: 22050}, "hello"); err == nil {
+		t.Error("built the input of a sample rate polly can't synthesize pcm at")
+	}
+}
+
+func TestSynthOptionsMerge(t *testing.T) {
+	defaults := SynthOptions{Voice: "Astrid", Format: "mp3", SampleRate: 22050, TextType: "text", Lexicons: []string{"names"}}
+	cases := []struct {
+		name string
+		o    SynthOptions
+		want SynthOptions
+	}{
+		{"defaults", SynthOptions{}, defaults},
+		{"overridden", SynthOptions{Voice: "Joanna", Format: "pcm", SampleRate: 16000, TextType: "ssml", Lexicons: []string{}},
+			SynthOptions{Voice: "Joanna", Format: "pcm", SampleRate: 16000, TextType: "ssml", Lexicons: []string{}}},
+		{"voice", SynthOptions{Voice: "Joanna"}, SynthOptions{Voice: "Joanna", Format: "mp3", SampleRate: 22050, TextType: "text", Lexicons: []string{"names"}}},
+	}
+	for _, c := range cases {
+		if got := c.o.merge(defaults); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: merged %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestSelectVoice(t *testing.T) {
+	voices := []*polly.Voice{{Id: aws.String("Joanna")}, {Id: aws.String("Matthew")}}
+	cases := []struct {
+		name   string
+		voices []*polly.Voice
+		id     string
+		want   string
+		err    string
+	}{
+		{"first", voices, "", "Joanna", ""},
+		{"chosen", voices, "Matthew", "Matthew", ""},
+		{"other language", voices, "Astrid", "", "available voices: Joanna, Matthew"},
+		{"no voices", nil, "", "", "--list-voices"},
+		{"no voices for the chosen one", nil, "Joanna", "", "--list-voices"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := selectVoice(c.voices, "en-US", c.id)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("selectVoice() = %s, %v, want an error with %q", got, err, c.err)
+				}
+				return
+			}
+			if err != nil || got != c.want {
+				t.Errorf("selectVoice() = %s, %v, want %s", got, err, c.want)
+			}
+		})
+	}
+}
+
+func TestNoVoices(t *testing.T) {
+	setOpts(t, func(o *options) { o.voiceCacheTTL = 0 })
+	sess := fakePolly(t, &countingProvider{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("LanguageCode") == "xx-XX" {
+			io.WriteString(w, `{"Voices":[]}`)
+			return
+		}
+		io.WriteString(w, `{"Voices":[{"Id":"Joanna","LanguageCode":"en-US"},{"Id":"Astrid","LanguageCode":"sv-SE"},{"Id":"Matthew","LanguageCode":"en-US"}]}`)
+	})
+	svc := polly.New(sess)
+
+	voices, err := describeVoices(svc, "xx-XX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := selectVoice(voices, "xx-XX", ""); err == nil || !strings.Contains(err.Error(), "Polly has no voices for xx-XX") {
+		t.Errorf("selectVoice() = %v, want an error that there are no voices", err)
+	}
+	err = listVoices(ioutil.Discard, svc, "xx-XX")
+	if want := "No voices for xx-XX, try one of: en-US, sv-SE"; err == nil || err.Error() != want {
+		t.Errorf("listVoices() = %v, want %s", err, want)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/slaskis/cloud-echo/echo"
+)
+
+// timeoutSynthesizer limits how long a synthesis may take until the first
+// of its audio has been read, so that a hung request doesn't stall the
+// pipeline. Reading the rest of the audio, which may be played as it's
+// read, isn't limited.
+type timeoutSynthesizer struct {
+	echo.Synthesizer
+	timeout time.Duration
+}
+
+// Synthesize implements echo.Synthesizer.
+func (s timeoutSynthesizer) Synthesize(ctx context.Context, text string) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &cancelReader{cancel: cancel, timeout: s.timeout}
+	r.timer = clock.AfterFunc(s.timeout, func() {
+		if atomic.CompareAndSwapInt32(&r.state, synthWaiting, synthExpired) {
+			cancel()
+		}
+	})
+	audio, err := s.Synthesizer.Synthesize(ctx, text)
+	if err != nil {
+		r.timer.Stop()
+		cancel()
+		if atomic.LoadInt32(&r.state) == synthExpired {
+			return nil, fmt.Errorf("timed out after %s: %v", s.timeout, err)
+		}
+		return nil, err
+	}
+	r.ReadCloser = audio
+	return r, nil
+}
+
+// the states of a cancelReader.
+const (
+	synthWaiting int32 = iota
+	synthReading
+	synthExpired
+)
+
+// cancelReader stops the timer of a synthesis once the first of its audio
+// has been read, and cancels its context once it's closed.
+type cancelReader struct {
+	io.ReadCloser
+	cancel  context.CancelFunc
+	timer   echo.Timer
+	timeout time.Duration
+	// state is synthWaiting for the first of the audio, synthReading once
+	// it's come, or synthExpired if it didn't in time.
+	state int32
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 || err != nil {
+		if !atomic.CompareAndSwapInt32(&r.state, synthWaiting, synthReading) && atomic.LoadInt32(&r.state) == synthExpired {
+			return 0, fmt.Errorf("timed out after %s waiting for the audio", r.timeout)
+		}
+		r.timer.Stop()
+	}
+	return n, err
+}
+
+func (r *cancelReader) Close() error {
+	r.timer.Stop()
+	defer r.cancel()
+	return r.ReadCloser.Close()
+}
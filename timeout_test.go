@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slaskis/cloud-echo/echo/echotest"
+)
+
+// stalledSynthesizer responds with its chunks of audio, unless it's told to
+// stall the request or its first byte, which it then does until its context
+// is done.
+type stalledSynthesizer struct {
+	request   bool
+	firstByte bool
+	chunks    []string
+}
+
+func (s stalledSynthesizer) Synthesize(ctx context.Context, text string) (io.ReadCloser, error) {
+	if s.request {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return ioutil.NopCloser(&stalledReader{ctx, s.firstByte, s.chunks}), nil
+}
+
+type stalledReader struct {
+	ctx    context.Context
+	stall  bool
+	chunks []string
+}
+
+func (r *stalledReader) Read(p []byte) (int, error) {
+	if r.stall {
+		<-r.ctx.Done()
+		return 0, r.ctx.Err()
+	}
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+func TestTimeoutSynthesizer(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	tests := []struct {
+		name  string
+		synth stalledSynthesizer
+		// wait is how long the clock is advanced by after the first read.
+		wait  time.Duration
+		audio string
+		err   string
+	}{
+		{
+			name:  "in time",
+			synth: stalledSynthesizer{chunks: []string{"a", "b"}},
+			audio: "ab",
+		},
+		{
+			name:  "stalled request",
+			synth: stalledSynthesizer{request: true},
+			err:   "timed out after 50ms",
+		},
+		{
+			name:  "stalled first byte",
+			synth: stalledSynthesizer{firstByte: true, chunks: []string{"a"}},
+			err:   "timed out after 50ms waiting for the audio",
+		},
+		{
+			name:  "audio read for longer than the timeout",
+			synth: stalledSynthesizer{chunks: []string{"a", "b", "c"}},
+			wait:  time.Minute,
+			audio: "abc",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := echotest.NewClock(time.Unix(0, 0))
+			useClock(t, c)
+			s := timeoutSynthesizer{tt.synth, timeout}
+			type result struct {
+				audio []byte
+				err   error
+			}
+			done := make(chan result)
+			go func() {
+				audio, err := s.Synthesize(context.Background(), "hello")
+				if err != nil {
+					done <- result{nil, err}
+					return
+				}
+				defer audio.Close()
+				p := make([]byte, 1)
+				n, err := audio.Read(p)
+				if err != nil {
+					done <- result{nil, err}
+					return
+				}
+				c.Advance(tt.wait)
+				b, err := ioutil.ReadAll(audio)
+				done <- result{append(p[:n], b...), err}
+			}()
+			if tt.err != "" {
+				// the synthesis stalls until it times out.
+				c.Wait(1)
+				c.Advance(timeout)
+			}
+			res := <-done
+			b, err := res.audio, res.err
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.audio {
+				t.Errorf("got audio %q, want %q", b, tt.audio)
+			}
+		})
+	}
+}
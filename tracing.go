@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slaskis/cloud-echo/echo"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// exportInterval is how often finished spans are sent to the collector.
+const exportInterval = 5 * time.Second
+
+// tracer sends spans to an OpenTelemetry collector with OTLP over http,
+// encoded as JSON. All methods are no-ops on a nil *tracer, like metrics.
+type tracer struct {
+	url string
+
+	mu    sync.Mutex
+	spans []otlpSpan
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// traces is set when tracing is enabled.
+var traces *tracer
+
+// newTracer creates a tracer exporting to the collector at endpoint, such
+// as http://localhost:4318.
+func newTracer(endpoint string) *tracer {
+	t := &tracer{
+		url:  strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		done: make(chan struct{}),
+	}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		ticker := clock.NewTicker(exportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+				t.export()
+			case <-t.done:
+				t.export()
+				return
+			}
+		}
+	}()
+	return t
+}
+
+// Close exports the remaining spans.
+func (t *tracer) Close() {
+	if t == nil {
+		return
+	}
+	close(t.done)
+	t.wg.Wait()
+}
+
+type spanKey struct{}
+
+// Start implements echo.Tracer.
+func (t *tracer) Start(ctx context.Context, name string) (context.Context, echo.Span) {
+	if t == nil {
+		return ctx, (*span)(nil)
+	}
+	s := &span{tracer: t, start: time.Now()}
+	s.data.Name = name
+	s.data.Kind = 1
+	s.data.SpanID = randomID(8)
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.data.TraceID = parent.data.TraceID
+		s.data.ParentSpanID = parent.data.SpanID
+	} else {
+		s.data.TraceID = randomID(16)
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// span is a span of a tracer, ended spans are exported.
+type span struct {
+	tracer *tracer
+	start  time.Time
+	data   otlpSpan
+	once   sync.Once
+}
+
+// SetAttribute implements echo.Span.
+func (s *span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	var v otlpValue
+	switch value := value.(type) {
+	case int:
+		v.IntValue = strconv.Itoa(value)
+	case int64:
+		v.IntValue = strconv.FormatInt(value, 10)
+	case bool:
+		v.BoolValue = &value
+	default:
+		v.StringValue = fmt.Sprint(value)
+	}
+	s.tracer.mu.Lock()
+	s.data.Attributes = append(s.data.Attributes, otlpAttribute{Key: key, Value: v})
+	s.tracer.mu.Unlock()
+}
+
+// End implements echo.Span.
+func (s *span) End() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		s.data.StartTimeUnixNano = strconv.FormatInt(s.start.UnixNano(), 10)
+		s.data.EndTimeUnixNano = strconv.FormatInt(time.Now().UnixNano(), 10)
+		s.tracer.mu.Lock()
+		s.tracer.spans = append(s.tracer.spans, s.data)
+		s.tracer.mu.Unlock()
+	})
+}
+
+// export sends the ended spans to the collector.
+func (t *tracer) export() {
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+
+	var req otlpRequest
+	req.ResourceSpans = []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: "cloud-echo"}}}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "cloud-echo"},
+			Spans: spans,
+		}},
+	}}
+	body, err := json.Marshal(req)
+	if err != nil {
+		errorf("Could not encode spans: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), exportInterval)
+	defer cancel()
+	resp, err := ctxhttp.Post(ctx, nil, t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		warnf("Could not export spans: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		warnf("Could not export spans: %s", resp.Status)
+	}
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// the OTLP JSON encoding of spans, see
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue,omitempty"`
+	IntValue    string `json:"intValue,omitempty"`
+	BoolValue   *bool  `json:"boolValue,omitempty"`
+}
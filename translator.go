@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context/ctxhttp"
+	"golang.org/x/oauth2/google"
+)
+
+const translateURL = "https://translation.googleapis.com/language/translate/v2"
+
+// GoogleTranslator translates text using the Google Cloud Translation API.
+type GoogleTranslator struct {
+	client *http.Client
+	source string
+	target string
+}
+
+// NewGoogleTranslator creates a Translator from the source to the target
+// language. Region subtags such as the "US" in "en-US" are ignored as the
+// API only deals with languages.
+func NewGoogleTranslator(ctx context.Context, source, target string) (*GoogleTranslator, error) {
+	client, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/cloud-translation")
+	if err != nil {
+		return nil, err
+	}
+	return &GoogleTranslator{
+		client: client,
+		source: baseLanguage(source),
+		target: baseLanguage(target),
+	}, nil
+}
+
+// Translate implements echo.Translator.
+func (t *GoogleTranslator) Translate(ctx context.Context, text string) (string, error) {
+	ctx, span := traces.Start(ctx, "google.translate")
+	defer span.End()
+	span.SetAttribute("text.length", len(text))
+	body, err := json.Marshal(map[string]string{
+		"q":      text,
+		"source": t.source,
+		"target": t.target,
+		"format": "text",
+	})
+	if err != nil {
+		return "", err
+	}
+	resp, err := ctxhttp.Post(ctx, t.client, translateURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("translate: unexpected status %s", resp.Status)
+	}
+
+	var result struct {
+		Data struct {
+			Translations []struct {
+				TranslatedText string `json:"translatedText"`
+			} `json:"translations"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if len(result.Data.Translations) == 0 {
+		return "", fmt.Errorf("translate: no translation returned")
+	}
+	return result.Data.Translations[0].TranslatedText, nil
+}
+
+func baseLanguage(code string) string {
+	return strings.SplitN(code, "-", 2)[0]
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/slaskis/cloud-echo/echo"
+)
+
+// vadHangover is how long to keep sending audio after the last chunk with
+// speech, so that quiet endings of words aren't cut off.
+const vadHangover = 500 * time.Millisecond
+
+// vadRecognizer only forwards the chunks of audio that contain speech to
+// its Recognizer. Speech is detected from the energy of the audio, so it
+// only works with raw 16-bit little endian samples (LINEAR16).
+type vadRecognizer struct {
+	echo.Recognizer
+	threshold float64
+	hangover  int
+	quiet     int
+}
+
+// newVADRecognizer wraps rec to skip silence. threshold is the RMS level,
+// as a fraction of full scale, above which a chunk is considered speech.
+func newVADRecognizer(rec echo.Recognizer, threshold float64, sampleRate int) *vadRecognizer {
+	hangover := int(vadHangover.Seconds() * float64(sampleRate) * 2)
+	return &vadRecognizer{
+		Recognizer: rec,
+		threshold:  threshold,
+		hangover:   hangover,
+		quiet:      hangover,
+	}
+}
+
+// SendAudio implements echo.Recognizer.
+func (v *vadRecognizer) SendAudio(audio []byte) error {
+	if rms(audio) >= v.threshold {
+		v.quiet = 0
+	} else {
+		v.quiet += len(audio)
+	}
+	if v.quiet > v.hangover {
+		debugf("skipping %d bytes of silence", len(audio))
+		return nil
+	}
+	return v.Recognizer.SendAudio(audio)
+}
+
+// rms returns the root mean square of the 16-bit samples in audio as a
+// fraction of full scale.
+func rms(audio []byte) float64 {
+	n := len(audio) / 2
+	if n == 0 {
+		return 0
+	}
+	var sum float64
+	for i := 0; i < n; i++ {
+		s := float64(int16(binary.LittleEndian.Uint16(audio[i*2:]))) / math.MaxInt16
+		sum += s * s
+	}
+	return math.Sqrt(sum / float64(n))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// samples encodes 16-bit samples as LINEAR16.
+func samples(s ...int16) []byte {
+	b := make([]byte, len(s)*2)
+	for i, v := range s {
+		binary.LittleEndian.PutUint16(b[i*2:], uint16(v))
+	}
+	return b
+}
+
+func TestRMS(t *testing.T) {
+	cases := []struct {
+		name  string
+		audio []byte
+		want  float64
+	}{
+		{"empty", nil, 0},
+		{"odd byte", []byte{0xff}, 0},
+		{"silence", samples(0, 0, 0, 0), 0},
+		{"full scale", samples(math.MaxInt16, -math.MaxInt16), 1},
+		{"half scale", samples(math.MaxInt16/2, -math.MaxInt16/2), 0.5},
+		{"square of a quarter", samples(math.MaxInt16/4, 0, math.MaxInt16/4, 0), 0.25 / math.Sqrt2},
+	}
+	for _, c := range cases {
+		if got := rms(c.audio); math.Abs(got-c.want) > 0.001 {
+			t.Errorf("%s: rms = %.4f, want %.4f", c.name, got, c.want)
+		}
+	}
+}
+
+func TestVADRecognizer(t *testing.T) {
+	sent := &sentRecognizer{}
+	// a hangover of 500ms at 1kHz is 1000 bytes.
+	v := newVADRecognizer(sent, 0.1, 1000)
+	speech := samples(math.MaxInt16/2, -math.MaxInt16/2)
+	silence := make([]byte, 400)
+
+	steps := []struct {
+		name  string
+		audio []byte
+		sent  bool
+	}{
+		{"leading silence", silence, false},
+		{"speech", speech, true},
+		{"silence in the hangover", silence, true},
+		{"more silence in the hangover", silence, true},
+		{"silence after the hangover", silence, false},
+		{"speech again", speech, true},
+		{"silence in the next hangover", silence, true},
+	}
+	for _, s := range steps {
+		before := len(sent.sent)
+		if err := v.SendAudio(s.audio); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(sent.sent) > before; got != s.sent {
+			t.Errorf("%s: sent %v, want %v", s.name, got, s.sent)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/polly"
+)
+
+// voiceCache is the on disk cache of the voices per language.
+type voiceCache map[string]cachedVoices
+
+type cachedVoices struct {
+	Fetched time.Time
+	Voices  []*polly.Voice
+}
+
+// voiceCachePath returns where the voice cache is kept.
+func voiceCachePath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "cloud-echo", "voices.json"), nil
+}
+
+func readVoiceCache(path string) voiceCache {
+	cache := voiceCache{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cache
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		warnf("Ignoring invalid voice cache %s: %v", path, err)
+		return voiceCache{}
+	}
+	return cache
+}
+
+func writeVoiceCache(path string, cache voiceCache) error {
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// describeVoices returns the voices for language, from the cache unless it's
+// older than --voice-cache-ttl or --refresh-voices is set.
+func describeVoices(svc *polly.Polly, language string) ([]*polly.Voice, error) {
+	path, err := voiceCachePath()
+	if err != nil {
+		warnf("Not caching voices: %v", err)
+	}
+	cache := voiceCache{}
+	if path != "" && opts.voiceCacheTTL > 0 {
+		cache = readVoiceCache(path)
+		if c, ok := cache[language]; ok && !opts.refreshVoices && clock.Now().Sub(c.Fetched) < opts.voiceCacheTTL {
+			debugf("using cached voices for %s from %s", language, c.Fetched)
+			return c.Voices, nil
+		}
+	}
+
+	resp, err := svc.DescribeVoices(&polly.DescribeVoicesInput{
+		LanguageCode: aws.String(language),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if path != "" && opts.voiceCacheTTL > 0 {
+		cache[language] = cachedVoices{clock.Now(), resp.Voices}
+		if err := writeVoiceCache(path, cache); err != nil {
+			warnf("Could not cache voices: %v", err)
+		}
+	}
+	return resp.Voices, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/slaskis/cloud-echo/echo"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// webhookRetries is how many times to retry posting a transcript.
+const webhookRetries = 2
+
+// webhook posts transcripts as json to a url in the background, so that a
+// slow or failing endpoint never holds up the echo.
+type webhook struct {
+	ctx     context.Context
+	url     string
+	backoff time.Duration
+	pending chan []byte
+	done    chan struct{}
+}
+
+func newWebhook(ctx context.Context, url string) *webhook {
+	h := &webhook{
+		ctx:     ctx,
+		url:     url,
+		backoff: 500 * time.Millisecond,
+		pending: make(chan []byte, 64),
+		done:    make(chan struct{}),
+	}
+	go h.run()
+	return h
+}
+
+// Send queues res to be posted. It's dropped if the queue is full.
+func (h *webhook) Send(res echo.Result) error {
+	body, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	select {
+	case h.pending <- body:
+	default:
+		warnf("webhook can't keep up, dropping '%s'", res.Transcript)
+	}
+	return nil
+}
+
+// Close waits for the queued transcripts to be posted.
+func (h *webhook) Close() {
+	close(h.pending)
+	<-h.done
+}
+
+func (h *webhook) run() {
+	defer close(h.done)
+	for body := range h.pending {
+		delay := h.backoff
+		for attempt := 0; ; attempt++ {
+			err := h.post(body)
+			if err == nil {
+				break
+			}
+			if attempt >= webhookRetries || h.ctx.Err() != nil || !retryable(err) {
+				errorf("Could not post transcript to %s: %v", h.url, err)
+				break
+			}
+			warnf("Could not post transcript to %s, retrying in %s: %v", h.url, delay, err)
+			select {
+			case <-clock.After(delay):
+			case <-h.ctx.Done():
+			}
+			delay *= 2
+		}
+	}
+}
+
+func (h *webhook) post(body []byte) error {
+	resp, err := ctxhttp.Post(h.ctx, nil, h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return temporaryError{err}
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		err := fmt.Errorf("unexpected status %s", resp.Status)
+		if resp.StatusCode >= 500 {
+			return temporaryError{err}
+		}
+		return err
+	}
+	return nil
+}
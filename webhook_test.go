@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slaskis/cloud-echo/echo"
+)
+
+func TestWebhook(t *testing.T) {
+	cases := []struct {
+		name     string
+		statuses []int
+		attempts int
+	}{
+		{"posted", []int{http.StatusOK}, 1},
+		{"no content", []int{http.StatusNoContent}, 1},
+		{"retried", []int{http.StatusServiceUnavailable, http.StatusOK}, 2},
+		{"out of retries", []int{500, 500, 500, 500}, webhookRetries + 1},
+		{"not retryable", []int{http.StatusBadRequest, http.StatusOK}, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			res := echo.Result{Transcript: "hello", Confidence: 0.9, IsFinal: true, Timestamp: time.Unix(1, 0).UTC()}
+			var mu sync.Mutex
+			attempts := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+					t.Errorf("posted a Content-Type of %q, want application/json", ct)
+				}
+				var got echo.Result
+				if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+					t.Errorf("posted invalid json: %v", err)
+				} else if !reflect.DeepEqual(got, res) {
+					t.Errorf("posted %+v, want %+v", got, res)
+				}
+				mu.Lock()
+				status := c.statuses[attempts]
+				attempts++
+				mu.Unlock()
+				w.WriteHeader(status)
+			}))
+			defer srv.Close()
+
+			h := newWebhook(context.Background(), srv.URL)
+			h.backoff = time.Millisecond
+			if err := h.Send(res); err != nil {
+				t.Fatal(err)
+			}
+			// Close waits for the transcript to be posted.
+			h.Close()
+			mu.Lock()
+			defer mu.Unlock()
+			if attempts != c.attempts {
+				t.Errorf("posted %d times, want %d", attempts, c.attempts)
+			}
+		})
+	}
+}